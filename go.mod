@@ -4,5 +4,6 @@ go 1.13
 
 require (
 	github.com/beevik/ntp v0.3.0
-	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
 )
@@ -8,19 +8,25 @@
 package main
 
 import (
+   "bytes"
    "flag"
    "fmt"
    "io/ioutil"
    "encoding/json"
    "net"
+   "net/http"
    "os"
    pNtp "github.com/beevik/ntp"
    pQ "github.com/networkimprov/mnm/qlib"
    "os/signal"
    "strconv"
    "strings"
+   "sync"
+   "syscall"
    "time"
    "crypto/tls"
+   pTerm "golang.org/x/crypto/ssh/terminal"
+   pWs "golang.org/x/net/websocket"
 )
 
 const kVersionA, kVersionB, kVersionC = 0, 2, 0
@@ -28,10 +34,19 @@ const kVersionDate = "(unreleased)"
 const kConfigFile = "mnm.config"
 
 var sConfig tConfig
+var sAdminReauth string // uid
+var sAdminDir string // requests saved by admin flags while server runs
+var sAdminMsgMax string // uid:octets
 
 
 func main() {
    aVersionQuit := flag.Bool("version", false, "print version and quit")
+   flag.StringVar(&sAdminReauth, "reauth", "",
+                  "require nodes of user `uid` to reauthenticate at next login, and quit;"+
+                  " while server runs, it applies this on SIGHUP")
+   flag.StringVar(&sAdminMsgMax, "msgmax", "",
+                  "set data size limit for a user as `uid:octets`, up to limits.msgmax or 0 for that, and quit;"+
+                  " while server runs, it applies this on SIGHUP")
    flag.Parse() // may os.Exit(2)
    if *aVersionQuit {
       fmt.Printf("mnm tmtp server v%d.%d.%d %s\n", kVersionA, kVersionB, kVersionC, kVersionDate)
@@ -45,8 +60,11 @@ func mainResult() int {
    var err error
 
    aTcNum := 0
-   if len(os.Args) == 2 {
-      aTcNum, err = strconv.Atoi(os.Args[1])
+   if flag.NArg() > 0 && (sAdminReauth != "" || sAdminMsgMax != "") {
+      fmt.Fprintf(os.Stderr, "admin: unexpected argument %s\n", flag.Arg(0))
+      return 1
+   } else if flag.NArg() == 1 {
+      aTcNum, err = strconv.Atoi(flag.Arg(0))
       if err != nil || aTcNum < 2 || aTcNum > 1000 {
          fmt.Fprintf(os.Stderr, "testclient count must be 2-1000\n")
          return 1
@@ -63,22 +81,78 @@ func mainResult() int {
       }
    }
 
+   aAdmin := tAdminReq{Reauth: sAdminReauth}
+   if sAdminMsgMax != "" {
+      a := strings.LastIndexByte(sAdminMsgMax, ':')
+      if a > 0 {
+         aAdmin.MsgMaxUid = sAdminMsgMax[:a]
+         aAdmin.MsgMax, err = strconv.ParseInt(sAdminMsgMax[a+1:], 10, 64)
+      }
+      if a <= 0 || err != nil || aAdmin.MsgMax < 0 {
+         fmt.Fprintf(os.Stderr, "msgmax: expected uid:octets, got %s\n", sAdminMsgMax)
+         return 1
+      }
+      if sConfig.Limits.MsgMax > 0 && aAdmin.MsgMax > sConfig.Limits.MsgMax {
+         fmt.Fprintf(os.Stderr, "msgmax: %d exceeds limits.msgmax %d\n", aAdmin.MsgMax, sConfig.Limits.MsgMax)
+         return 1
+      }
+   }
+
    fmt.Printf("mnm tmtp server v%d.%d.%d %s\nntp time %v\n",
               kVersionA, kVersionB, kVersionC, kVersionDate, sConfig.Ntp.time.UTC())
 
    aDbName := "userdb"; if aTcNum != 0 { aDbName += "-test-qlib" }
-   pQ.UDb, err = NewUserDb(aDbName)
+   if aTcNum != 0 {
+      _ = setNodeKdf(tKdf{Alg: "scrypt", N: 1<<10, R: 8, P: 1}) // keep test pass quick
+   }
+   var aKey []byte
+   if sConfig.UserDbKey != "" {
+      aKey, err = readUserDbKey(sConfig.UserDbKey)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "userdb key: %s\n", err.Error())
+         return 1
+      }
+   }
+   sAdminDir = aDbName + "-admin"
+   pQ.UDb, err = NewUserDb(aDbName, aKey)
+   if aUe, _ := err.(*tUdbError); aUe != nil && aUe.id == eErrDbLocked && aAdmin != (tAdminReq{}) {
+      err = aAdmin.save()
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "admin: %s\n", err.Error())
+         return 1
+      }
+      fmt.Printf("admin: server is running; send it SIGHUP to apply request\n")
+      return 0
+   }
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+      return 1
+   }
+   err = aAdmin.apply()
    if err != nil {
       fmt.Fprintf(os.Stderr, "%s\n", err.Error())
       return 1
    }
+   if sAdminReauth != "" || sAdminMsgMax != "" {
+      return 0
+   }
 
    aQstore := "qstore"; if aTcNum != 0 { aQstore += "-test" }
-   pQ.Init(aQstore, sConfig.Ntp.time)
+   var aQkey []byte
+   if sConfig.QstoreCrypt {
+      aQkey = aKey
+   } else if aTcNum != 0 {
+      aQkey = []byte("test") // exercise msg file encryption
+   }
+   err = pQ.Init(aQstore, sConfig.Ntp.time, aQkey)
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+      return 1
+   }
 
    if aTcNum != 0 {
       fmt.Printf("Starting Test Pass\n")
-      if TestUserDb("userdb-test-unit") {
+      if TestUserDb("userdb-test-unit") && TestWsConn() {
          pQ.LocalTest(aTcNum)
       }
       pQ.UDb.Erase()
@@ -103,11 +177,18 @@ type tConfig struct {
    Listen struct {
       Net string
       Laddr string
+      WsLaddr, WsPath string // optional WebSocket listener
+      WsOrigins []string // optional; browser origins allowed to connect
       CertPath, KeyPath string
    }
    Name string
    Auth byte
    AuthBy []pQ.TAuthBy
+   Limits pQ.TLimits
+   Reauth pQ.TReauth // when a node must reauthenticate
+   UserDbKey string // file containing key, or "-" to prompt; omit for plaintext userdb
+   QstoreCrypt bool // encrypt msg files with UserDbKey
+   NodeKdf *tKdf // hash for node secrets; omit for default
 }
 
 func (o *tConfig) load() error {
@@ -116,8 +197,17 @@ func (o *tConfig) load() error {
    err = json.Unmarshal(aBuf, o)
    if err != nil { return err }
 
-   err = pQ.SetTmtpRev(o.Name, o.Auth, o.AuthBy) // modifies .AuthBy
+   err = pQ.SetTmtpRev(o.Name, o.Auth, o.AuthBy, o.Limits) // modifies .AuthBy
    if err != nil { return err }
+   err = pQ.SetReauthPolicy(o.Reauth)
+   if err != nil { return err }
+   if o.QstoreCrypt && o.UserDbKey == "" {
+      return tError("qstorecrypt requires userdbkey")
+   }
+   if o.NodeKdf != nil {
+      err = setNodeKdf(*o.NodeKdf)
+      if err != nil { return err }
+   }
 
    for _, aHost := range o.Ntp.Hosts {
       for a := uint8(0); a < o.Ntp.Retries; a++ {
@@ -132,6 +222,77 @@ func (o *tConfig) load() error {
    return tError("ntp not available")
 }
 
+func readUserDbKey(iPath string) ([]byte, error) {
+   if iPath != "-" {
+      aBuf, err := ioutil.ReadFile(iPath)
+      return bytes.TrimRight(aBuf, "\r\n"), err
+   }
+   fmt.Fprintf(os.Stderr, "userdb key: ")
+   aBuf, err := pTerm.ReadPassword(int(os.Stdin.Fd()))
+   fmt.Fprintf(os.Stderr, "\n")
+   return aBuf, err
+}
+
+// an admin request; saved for the server if it's running
+type tAdminReq struct {
+   Reauth string `json:",omitempty"` // uid
+   MsgMaxUid string `json:",omitempty"`
+   MsgMax int64 `json:",omitempty"` // 0 for limits.msgmax
+}
+
+func (o *tAdminReq) apply() error {
+   if o.Reauth != "" {
+      err := pQ.UDb.SetReauth(o.Reauth, "", true)
+      if err != nil { return tError("reauth: "+ err.Error()) }
+      fmt.Printf("reauth: nodes of %s must reauthenticate\n", o.Reauth)
+   }
+   if o.MsgMaxUid != "" {
+      err := pQ.UDb.SetMsgMax(o.MsgMaxUid, o.MsgMax)
+      if err != nil { return tError("msgmax: "+ err.Error()) }
+      fmt.Printf("msgmax: limit of %s is %d\n", o.MsgMaxUid, o.MsgMax)
+   }
+   return nil
+}
+
+func (o *tAdminReq) save() error {
+   err := os.MkdirAll(sAdminDir, 0700)
+   if err != nil { return err }
+   aBuf, err := json.Marshal(o)
+   if err != nil { return err }
+   aName := fmt.Sprint(time.Now().UnixNano()) + ".json"
+   err = ioutil.WriteFile(sAdminDir +"/."+ aName, aBuf, 0600) // hidden until complete
+   if err != nil { return err }
+   return os.Rename(sAdminDir +"/."+ aName, sAdminDir +"/"+ aName)
+}
+
+// apply & remove saved admin requests, in order
+func runAdminReqs() {
+   aList, err := ioutil.ReadDir(sAdminDir)
+   if err != nil {
+      if !os.IsNotExist(err) {
+         fmt.Fprintf(os.Stderr, "admin: %s\n", err.Error())
+      }
+      return
+   }
+   for _, aFi := range aList {
+      if strings.HasPrefix(aFi.Name(), ".") {
+         continue
+      }
+      aPath := sAdminDir +"/"+ aFi.Name()
+      var aReq tAdminReq
+      aBuf, err := ioutil.ReadFile(aPath)
+      if err == nil { err = json.Unmarshal(aBuf, &aReq) }
+      if err == nil { err = aReq.apply() }
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "admin %s: %s\n", aFi.Name(), err.Error())
+      }
+      err = os.Remove(aPath)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "admin: %s\n", err.Error())
+      }
+   }
+}
+
 func startServer(iConf *tConfig) error {
    var err error
    aCfgTcp := net.ListenConfig{KeepAlive: -1}
@@ -142,10 +303,31 @@ func startServer(iConf *tConfig) error {
    aCfgTls := tls.Config{Certificates: []tls.Certificate{aCert}}
    aListener = tls.NewListener(aListener, &aCfgTls)
 
+   var aWsServer *http.Server
+   if iConf.Listen.WsLaddr != "" {
+      aWsServer, err = startWsServer(iConf, &aCfgTcp, &aCfgTls)
+      if err != nil {
+         aListener.Close()
+         return err
+      }
+   }
+
+   runAdminReqs() // saved since last SIGHUP
+   aHupWatch := make(chan os.Signal, 1)
+   signal.Notify(aHupWatch, syscall.SIGHUP)
+   go func() {
+      for range aHupWatch {
+         runAdminReqs()
+      }
+   }()
+
    aIntWatch := make(chan os.Signal, 1)
    signal.Notify(aIntWatch, os.Interrupt)
    go func() {
       <-aIntWatch
+      if aWsServer != nil {
+         aWsServer.Close()
+      }
       aListener.Close()
    }()
 
@@ -175,6 +357,66 @@ func startServer(iConf *tConfig) error {
    }
 }
 
+func startWsServer(iConf *tConfig, iCfgTcp *net.ListenConfig, iCfgTls *tls.Config) (*http.Server, error) {
+   aListener, err := iCfgTcp.Listen(nil, iConf.Listen.Net, iConf.Listen.WsLaddr)
+   if err != nil { return nil, err }
+   aListener = tls.NewListener(aListener, iCfgTls)
+
+   aPath := iConf.Listen.WsPath; if aPath == "" { aPath = "/" }
+   aMux := http.NewServeMux()
+   aMux.Handle(aPath, newWsServer(iConf.Listen.WsOrigins))
+   aServer := &http.Server{Handler: aMux, ReadHeaderTimeout: 5 * time.Second}
+   go func() {
+      err := aServer.Serve(aListener)
+      if err != http.ErrServerClosed {
+         fmt.Fprintf(os.Stderr, "websocket server exit: %s\n", err.Error())
+      }
+   }()
+   return aServer, nil
+}
+
+// accept requests with Origin in iOrigins, or any if none given; see README
+func newWsServer(iOrigins []string) pWs.Server {
+   fCheck := func(cCfg *pWs.Config, cReq *http.Request) error {
+      cOrigin := cReq.Header.Get("Origin")
+      if len(iOrigins) == 0 || cOrigin == "" { // not from a browser page
+         return nil
+      }
+      for _, cAllow := range iOrigins {
+         if strings.EqualFold(cAllow, cOrigin) { return nil }
+      }
+      fmt.Fprintf(os.Stderr, "websocket origin %s not allowed for %s\n", cOrigin, cReq.RemoteAddr)
+      return tError("origin not allowed")
+   }
+   return pWs.Server{Handler: runWsConn, Handshake: fCheck}
+}
+
+type tWsConn struct { // adapts WebSocket to the net.Conn expected by pQ
+   *pWs.Conn
+   addr net.Addr // client address
+   done chan struct{} // closed when link is done
+   once sync.Once
+}
+
+func runWsConn(iWs *pWs.Conn) {
+   iWs.PayloadType = pWs.BinaryFrame
+   aConn := &tWsConn{Conn: iWs, addr: iWs.RemoteAddr(), done: make(chan struct{})}
+   aAddr, err := net.ResolveTCPAddr("tcp", iWs.Request().RemoteAddr)
+   if err == nil {
+      aConn.addr = aAddr
+   }
+   pQ.NewLink(aConn)
+   <-aConn.done // WebSocket closes when handler returns
+}
+
+func (o *tWsConn) RemoteAddr() net.Addr { return o.addr }
+
+func (o *tWsConn) Close() error {
+   err := o.Conn.Close()
+   o.once.Do(func() { close(o.done) })
+   return err
+}
+
 type tError string
 func (o tError) Error() string { return string(o) }
 
@@ -0,0 +1,217 @@
+// Copyright 2026 Liam Breck
+// Published at https://github.com/networkimprov/mnm
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package qlib
+
+import (
+   "crypto/aes"
+   "crypto/cipher"
+   "crypto/hmac"
+   "crypto/rand"
+   "crypto/sha256"
+   "encoding/binary"
+   "encoding/json"
+   "io"
+   "io/ioutil"
+   "os"
+   pScrypt "golang.org/x/crypto/scrypt"
+)
+
+// An encrypted msg file has a header of kFileCrypt and a random salt, followed by
+// segments of up to kSegmentLen plaintext octets, each sealed with a per-file key
+// derived from the salt. Segment nonces count from zero and flag the last segment,
+// so truncation or reordering fails to open. Plaintext msg files begin with a hex digit.
+
+const kFileCrypt byte = 1
+const kFileSaltLen = 16
+const kSegmentLen = 1 << 16
+const kStoreCryptFile = "crypt"
+const kStoreCheck = "mnm qstore key check"
+
+type tStoreCrypt struct { // stored in Root/crypt
+   Salt []byte
+   Check []byte // keyed hash of kStoreCheck, to verify key
+}
+
+// derive key from passphrase; with neither crypt file nor passphrase, files are plaintext
+func (o *tStore) openCrypt(iPass []byte) error {
+   var aCrypt tStoreCrypt
+   aBuf, err := ioutil.ReadFile(o.Root + kStoreCryptFile)
+   if err == nil {
+      err = json.Unmarshal(aBuf, &aCrypt)
+      if err != nil { return err }
+      if iPass == nil {
+         return tError("qstore is encrypted; key required")
+      }
+   } else if !os.IsNotExist(err) {
+      return err
+   } else if iPass == nil {
+      return nil
+   } else {
+      aCrypt.Salt = make([]byte, kFileSaltLen)
+      _, err = rand.Read(aCrypt.Salt)
+      if err != nil { panic(err) }
+   }
+   if len(iPass) == 0 {
+      return tError("qstore key is empty")
+   }
+   o.key, err = pScrypt.Key(iPass, aCrypt.Salt, 1<<15, 8, 1, 32)
+   if err != nil { return err }
+   aMac := hmac.New(sha256.New, o.key)
+   aMac.Write([]byte(kStoreCheck))
+   if aCrypt.Check != nil {
+      if !hmac.Equal(aCrypt.Check, aMac.Sum(nil)) {
+         return tError("qstore key incorrect")
+      }
+      return nil
+   }
+   aCrypt.Check = aMac.Sum(nil)
+   aBuf, err = json.Marshal(&aCrypt)
+   if err != nil { panic(err) }
+   aFd, err := os.OpenFile(o.Root + kStoreCryptFile +".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+   if err != nil { return err }
+   _, err = aFd.Write(aBuf)
+   if err == nil {
+      err = aFd.Sync()
+   }
+   aFd.Close()
+   if err != nil { return err }
+   err = os.Rename(o.Root + kStoreCryptFile +".tmp", o.Root + kStoreCryptFile)
+   if err != nil { return err }
+   return o._syncRoot()
+}
+
+func (o *tStore) _syncRoot() error {
+   aFd, err := os.Open(o.Root)
+   if err != nil { return err }
+   err = aFd.Sync()
+   aFd.Close()
+   return err
+}
+
+func (o *tStore) _fileAead(iSalt []byte) cipher.AEAD {
+   aMac := hmac.New(sha256.New, o.key)
+   aMac.Write(iSalt)
+   aBlock, err := aes.NewCipher(aMac.Sum(nil))
+   if err != nil { panic(err) }
+   aAead, err := cipher.NewGCM(aBlock)
+   if err != nil { panic(err) }
+   return aAead
+}
+
+func _segmentNonce(iSeg uint64, iLast bool) []byte {
+   aNonce := make([]byte, 12)
+   binary.BigEndian.PutUint64(aNonce[3:11], iSeg)
+   if iLast {
+      aNonce[11] = 1
+   }
+   return aNonce
+}
+
+type tSealWriter struct {
+   file io.Writer
+   aead cipher.AEAD
+   seg uint64
+   buf, out []byte // plaintext pending, sealed segment
+}
+
+// write header to iFile; caller must close() the result after writing all data
+func (o *tStore) _newSealWriter(iFile io.Writer) (*tSealWriter, error) {
+   aHead := make([]byte, 1 + kFileSaltLen)
+   aHead[0] = kFileCrypt
+   _, err := rand.Read(aHead[1:])
+   if err != nil { panic(err) }
+   _, err = iFile.Write(aHead)
+   if err != nil { return nil, err }
+   aAead := o._fileAead(aHead[1:])
+   return &tSealWriter{file: iFile, aead: aAead, buf: make([]byte, 0, kSegmentLen),
+                       out: make([]byte, 0, kSegmentLen + aAead.Overhead())}, nil
+}
+
+func (o *tSealWriter) Write(iBuf []byte) (int, error) {
+   aLen := len(iBuf)
+   for len(iBuf) > 0 {
+      if len(o.buf) == kSegmentLen { // seal only when more follows, so last segment is flagged
+         err := o._seal(false)
+         if err != nil { return aLen - len(iBuf), err }
+      }
+      aN := copy(o.buf[len(o.buf):kSegmentLen], iBuf)
+      o.buf = o.buf[:len(o.buf)+aN]
+      iBuf = iBuf[aN:]
+   }
+   return aLen, nil
+}
+
+func (o *tSealWriter) close() error {
+   return o._seal(true)
+}
+
+func (o *tSealWriter) _seal(iLast bool) error {
+   o.out = o.aead.Seal(o.out[:0], _segmentNonce(o.seg, iLast), o.buf, nil)
+   o.buf = o.buf[:0]
+   o.seg++
+   _, err := o.file.Write(o.out)
+   return err
+}
+
+type tOpenReader struct {
+   file io.Reader
+   aead cipher.AEAD
+   seg uint64
+   left int64 // sealed octets not yet read
+   in, plain []byte // sealed segment, opened segment
+   out []byte // unread part of plain
+}
+
+func (o *tOpenReader) Read(iBuf []byte) (int, error) {
+   if len(o.out) == 0 {
+      if o.left == 0 {
+         return 0, io.EOF
+      }
+      aLen := int64(cap(o.in)); if aLen > o.left { aLen = o.left }
+      _, err := io.ReadFull(o.file, o.in[:aLen])
+      if err != nil { return 0, err }
+      o.left -= aLen
+      o.out, err = o.aead.Open(o.plain[:0], _segmentNonce(o.seg, o.left == 0), o.in[:aLen], nil)
+      if err != nil { return 0, err }
+      o.seg++
+   }
+   aN := copy(iBuf, o.out)
+   o.out = o.out[aN:]
+   return aN, nil
+}
+
+// open msg file, decrypting if sealed; caller must close the *os.File
+func (o *tStore) _openFile(iPath string) (*os.File, io.Reader, error) {
+   aFd, err := os.Open(iPath)
+   if err != nil { return nil, nil, err }
+   aHead := make([]byte, 1 + kFileSaltLen)
+   aLen, err := io.ReadFull(aFd, aHead)
+   if aLen == 0 || aHead[0] != kFileCrypt {
+      _, err = aFd.Seek(0, io.SeekStart)
+      if err != nil {
+         aFd.Close()
+         return nil, nil, err
+      }
+      return aFd, aFd, nil
+   }
+   if err == nil && o.key == nil {
+      err = tError("sealed msg file in plaintext qstore")
+   }
+   var aFi os.FileInfo
+   if err == nil {
+      aFi, err = aFd.Stat()
+   }
+   if err != nil {
+      aFd.Close()
+      return nil, nil, err
+   }
+   aAead := o._fileAead(aHead[1:])
+   return aFd, &tOpenReader{file: aFd, aead: aAead, left: aFi.Size() - int64(len(aHead)),
+                            in: make([]byte, kSegmentLen + aAead.Overhead()),
+                            plain: make([]byte, 0, kSegmentLen)}, nil
+}
@@ -17,30 +17,60 @@ import (
    "net/http"
    "encoding/json"
    "os"
+   "crypto/ecdsa"
+   "crypto/ed25519"
+   "crypto/elliptic"
    "crypto/rand"
    "crypto/rsa"
    "crypto/sha256"
+   "crypto/sha512"
+   "net/url"
    "strconv"
+   "strings"
+   "sync"
    "time"
 )
 
-var sOpenidCfg []tOpenidCfg
+// Keys are fetched at startup, re-fetched every kOpenidRefresh, and on demand when a token
+// gives an unknown key id, at most once per sOpenidRefetchWait. Without a keys URL, the
+// issuer's discovery document gives it. A node may give a refresh token in place of an
+// id_token at login; the server then obtains a new id_token from the provider's token URL.
+// A token from a client must give the link's nonce, and be issued within kOpenidAgeMax, so a
+// captured token can't be replayed on another link.
+
+const kOpenidRefresh = 12 * time.Hour
+const kOpenidRetry = 5 * time.Minute // interval to check for refresh, or retry a failed fetch
+const kOpenidDiscovery = "/.well-known/openid-configuration"
+const kOpenidSkew = 2 * time.Minute // allowed for clock difference with provider
+const kOpenidAgeMax = 10 * time.Minute // oldest iat, and auth_time of token from client
+
+var sOpenidRefetchWait = time.Minute
+var sOpenidClient = &http.Client{Timeout: 10 * time.Second}
+var sOpenidCfg []*tOpenidCfg
+var sOpenidDoor sync.RWMutex // guards sOpenidCfg
+var sOpenidRefresher sync.Once
 
 type tOpenidCfg struct {
    url, iss string
    aud string
+   token, std string // token URL & standard params, for refresh
+   door sync.Mutex // guards fields below
    keys []tOpenidKey
+   fetched, refetched time.Time
 }
 
 type tOpenidKey struct {
    Kty, Alg, Use string
    Kid string
-   E tBase64Int
-   N *tBase64BigInt
+   E tBase64Int // RSA
+   N *tBase64BigInt // RSA
+   Crv string // EC & OKP
+   X, Y tBase64Bytes // EC; OKP has only X
 }
 
 type tBase64Int int
 type tBase64BigInt big.Int
+type tBase64Bytes []byte
 
 func (o *tBase64Int) UnmarshalJSON(iStr []byte) error {
    iStr, err := _decodeBase64Url(iStr[1:len(iStr)-1])
@@ -59,6 +89,13 @@ func (o *tBase64BigInt) UnmarshalJSON(iStr []byte) error {
    return nil
 }
 
+func (o *tBase64Bytes) UnmarshalJSON(iStr []byte) error {
+   iStr, err := _decodeBase64Url(iStr[1:len(iStr)-1])
+   if err != nil { return err }
+   *o = append(tBase64Bytes(nil), iStr...) // iStr belongs to caller
+   return nil
+}
+
 func _decodeBase64Url(iStr []byte) ([]byte, error) {
    aLen, err := base64.RawURLEncoding.Decode(iStr, iStr)
    return iStr[:aLen], err
@@ -78,14 +115,37 @@ type tOpenidHeader struct {
 
 type tOpenidClaims struct {
    Ver int
-   Sub, Aud, Idp string
+   Sub, Idp string
+   Aud tOpenidAud
+   Azp string
    Iss string
-   Iat, Exp, Auth_time tUnixTime
+   Iat, Exp, Nbf, Auth_time tUnixTime
+   Nonce string
    Jti string
    Amr []string
    At_hash string
 }
 
+type tOpenidAud []string // string or array in JSON
+
+func (o *tOpenidAud) UnmarshalJSON(iStr []byte) error {
+   if len(iStr) > 0 && iStr[0] == '[' {
+      return json.Unmarshal(iStr, (*[]string)(o))
+   }
+   var aS string
+   err := json.Unmarshal(iStr, &aS)
+   if err != nil { return err }
+   *o = tOpenidAud{aS}
+   return nil
+}
+
+func (o tOpenidAud) has(iAud string) bool {
+   for _, aS := range o {
+      if aS == iAud { return true }
+   }
+   return false
+}
+
 type tUnixTime struct { time.Time }
 
 func (o *tUnixTime) UnmarshalJSON(iStr []byte) error {
@@ -95,43 +155,198 @@ func (o *tUnixTime) UnmarshalJSON(iStr []byte) error {
    return nil
 }
 
-func clearConfigOpenid() { sOpenidCfg = nil }
+func clearConfigOpenid() {
+   sOpenidDoor.Lock()
+   sOpenidCfg = nil
+   sOpenidDoor.Unlock()
+}
 
-func addConfigOpenid(iUrl string, iIss string, iAud string) {
-   sOpenidCfg = append(sOpenidCfg, tOpenidCfg{url: iUrl, iss: iIss, aud: iAud})
+func addConfigOpenid(iUrl string, iIss string, iAud string, iToken, iStd string) {
+   sOpenidDoor.Lock()
+   sOpenidCfg = append(sOpenidCfg, &tOpenidCfg{url: iUrl, iss: iIss, aud: iAud, token: iToken, std: iStd})
+   sOpenidDoor.Unlock()
 }
 
 func initOpenid() {
-   for a := range sOpenidCfg {
-      aResp, err := http.Get(sOpenidCfg[a].url)
+   sOpenidDoor.RLock()
+   for _, aCfg := range sOpenidCfg {
+      err := aCfg.fetchKeys()
       if err != nil {
-         fmt.Fprintf(os.Stderr, "OpenID config: could not obtain %s: %v\n  restart to retry",
-                                sOpenidCfg[a].url, err)
-         continue
+         fmt.Fprintf(os.Stderr, "OpenID config: %v\n  will retry in %v\n", err, kOpenidRetry)
       }
-      var aKeys struct { Keys []tOpenidKey }
-      err = json.NewDecoder(aResp.Body).Decode(&aKeys)
-      aResp.Body.Close()
-      if err != nil {
-         fmt.Fprintf(os.Stderr, "OpenID config: could not parse response from %s: %v\n  restart to retry",
-                                sOpenidCfg[a].url, err)
-         continue
+   }
+   sOpenidDoor.RUnlock()
+   sOpenidRefresher.Do(func() { go _runOpenidRefresh() })
+}
+
+func _runOpenidRefresh() {
+   for {
+      time.Sleep(kOpenidRetry)
+      sOpenidDoor.RLock()
+      aList := sOpenidCfg
+      sOpenidDoor.RUnlock()
+      for _, aCfg := range aList {
+         aCfg.door.Lock()
+         aDue := aCfg.keys == nil || time.Since(aCfg.fetched) >= kOpenidRefresh
+         aCfg.door.Unlock()
+         if !aDue { continue }
+         err := aCfg.fetchKeys()
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "OpenID refresh: %v\n", err)
+         }
       }
-      sOpenidCfg[a].keys = aKeys.Keys
    }
 }
 
-func validateTokenOpenid(iTok *tOpenidToken) (tMsg, error) {
+// return key for id & alg, re-fetching keys if it's unknown and the last re-fetch wasn't recent
+func (o *tOpenidCfg) getKey(iKid, iAlg string) *tOpenidKey {
+   o.door.Lock()
+   aKey := o._findKey(iKid, iAlg)
+   aFetch := aKey == nil && time.Since(o.refetched) >= sOpenidRefetchWait
+   if aFetch {
+      o.refetched = time.Now()
+   }
+   o.door.Unlock()
+   if !aFetch {
+      return aKey
+   }
+   err := o.fetchKeys()
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "OpenID refetch: %v\n", err)
+      return nil
+   }
+   o.door.Lock(); defer o.door.Unlock()
+   return o._findKey(iKid, iAlg)
+}
+
+func (o *tOpenidCfg) _findKey(iKid, iAlg string) *tOpenidKey {
+   for a := range o.keys {
+      if o.keys[a].Kid == iKid && (o.keys[a].Alg == iAlg || o.keys[a].Alg == "") { // alg is optional
+         return &o.keys[a]
+      }
+   }
+   return nil
+}
+
+func (o *tOpenidCfg) fetchKeys() error {
+   aUrl := o.url
+   if aUrl == "" {
+      var aDisc struct { Issuer, Jwks_uri string }
+      err := _getJsonOpenid(strings.TrimSuffix(o.iss, "/") + kOpenidDiscovery, "", &aDisc)
+      if err != nil { return err }
+      if aDisc.Issuer != o.iss || aDisc.Jwks_uri == "" {
+         return tError("discovery document for "+ o.iss +" has wrong issuer or no jwks_uri")
+      }
+      aUrl = aDisc.Jwks_uri
+   }
+   var aKeys struct { Keys []tOpenidKey }
+   err := _getJsonOpenid(aUrl, "", &aKeys)
+   if err != nil { return err }
+   o.door.Lock()
+   o.keys, o.fetched = aKeys.Keys, time.Now()
+   o.door.Unlock()
+   return nil
+}
+
+// GET iUrl, or POST iForm to it if given, and parse the JSON response
+func _getJsonOpenid(iUrl string, iForm string, iObj interface{}) error {
+   var aResp *http.Response
+   var err error
+   if iForm == "" {
+      aResp, err = sOpenidClient.Get(iUrl)
+   } else {
+      aResp, err = sOpenidClient.Post(iUrl, "application/x-www-form-urlencoded", strings.NewReader(iForm))
+   }
+   if err != nil {
+      return fmt.Errorf("could not obtain %s: %v", iUrl, err)
+   }
+   defer aResp.Body.Close()
+   if aResp.StatusCode != http.StatusOK {
+      return fmt.Errorf("could not obtain %s: %s", iUrl, aResp.Status)
+   }
+   err = json.NewDecoder(aResp.Body).Decode(iObj)
+   if err != nil {
+      return fmt.Errorf("could not parse response from %s: %v", iUrl, err)
+   }
+   return nil
+}
+
+// obtain new tokens from provider for iIss with a refresh token
+func refreshTokenOpenid(iIss, iRefresh string) (*tOpenidToken, error) {
+   var aCfg *tOpenidCfg
+   sOpenidDoor.RLock()
+   for _, aC := range sOpenidCfg {
+      if aC.iss == iIss {
+         aCfg = aC
+         break
+      }
+   }
+   sOpenidDoor.RUnlock()
+   if aCfg == nil {
+      return nil, tError("OpenID issuer not configured: "+ iIss)
+   }
+   aForm := "grant_type=refresh_token&refresh_token="+ url.QueryEscape(iRefresh)
+   if aCfg.std != "" {
+      aForm += "&"+ aCfg.std
+   }
+   var aTok tOpenidToken
+   err := _getJsonOpenid(aCfg.token, aForm, &aTok)
+   if err != nil { return nil, err }
+   if aTok.Id_token == "" {
+      return nil, tError("OpenID refresh response lacks id_token")
+   }
+   return &aTok, nil
+}
+
+// verify signature of iInput by key for iAlg; algs are RS256, ES256, ES384, EdDSA (Ed25519)
+func (o *tOpenidKey) verify(iAlg string, iInput, iSig []byte) bool {
+   switch iAlg {
+   case "RS256":
+      if o.Kty != "RSA" || o.N == nil { return false }
+      aHash := sha256.Sum256(iInput)
+      aPk := &rsa.PublicKey{N: (*big.Int)(o.N), E: int(o.E)}
+      return rsa.VerifyPKCS1v15(aPk, crypto.SHA256, aHash[:], iSig) == nil
+   case "ES256", "ES384":
+      aCurve := elliptic.P256()
+      var aHash []byte
+      if iAlg == "ES384" {
+         aCurve = elliptic.P384()
+         aSum := sha512.Sum384(iInput); aHash = aSum[:]
+      } else {
+         aSum := sha256.Sum256(iInput); aHash = aSum[:]
+      }
+      if o.Kty != "EC" || o.Crv != aCurve.Params().Name { return false }
+      aPk := &ecdsa.PublicKey{Curve: aCurve, X: new(big.Int).SetBytes(o.X), Y: new(big.Int).SetBytes(o.Y)}
+      if !aCurve.IsOnCurve(aPk.X, aPk.Y) { return false }
+      aLen := (aCurve.Params().BitSize + 7) / 8
+      if len(iSig) != 2 * aLen { return false } // JWS gives r|s, not ASN.1
+      return ecdsa.Verify(aPk, aHash, new(big.Int).SetBytes(iSig[:aLen]), new(big.Int).SetBytes(iSig[aLen:]))
+   case "EdDSA":
+      if o.Kty != "OKP" || o.Crv != "Ed25519" || len(o.X) != ed25519.PublicKeySize { return false }
+      return ed25519.Verify(ed25519.PublicKey(o.X), iInput, iSig)
+   }
+   return false
+}
+
+// return nonce for client to give provider, so its id_token is bound to this link
+func makeNonceOpenid() string {
+   aData := make([]byte, 16)
+   _, err := rand.Read(aData)
+   if err != nil { panic(err) }
+   return base64.RawURLEncoding.EncodeToString(aData)
+}
+
+// iNonce is from the link's tmtprev response or reauth challenge, and the token must give it;
+// iNonce is empty for a token the server obtained from the provider with a refresh token,
+// whose auth_time is the original authentication
+func validateTokenOpenid(iTok *tOpenidToken, iNonce string) (tMsg, error) {
    var err error
    aSet := bytes.Split([]byte(iTok.Id_token), []byte{'.'})
    if len(aSet) != 3 {
       return nil, tError("OpenID id_token string invalid")
    }
 
-   aHash := sha256.New()
-   aHash.Write(aSet[0])
-   aHash.Write([]byte{'.'})
-   aHash.Write(aSet[1])
+   aInput := []byte(iTok.Id_token[:len(aSet[0]) + 1 + len(aSet[1])])
 
    for a := range aSet {
       aSet[a], err = _decodeBase64Url(aSet[a])
@@ -151,84 +366,42 @@ func validateTokenOpenid(iTok *tOpenidToken) (tMsg, error) {
       return nil, tError("OpenID id_token JSON invalid")
    }
 
-   if aClaims.Exp.Before(time.Now()) {
+   aNow := time.Now()
+   if aClaims.Exp.Before(aNow) {
       return nil, tError("OpenID id_token expired")
    }
+   if aClaims.Nbf.After(aNow.Add(kOpenidSkew)) || aClaims.Iat.After(aNow.Add(kOpenidSkew)) {
+      return nil, tError("OpenID id_token not yet valid")
+   }
+   if aClaims.Iat.IsZero() || aClaims.Iat.Before(aNow.Add(-kOpenidAgeMax)) ||
+      iNonce != "" && !aClaims.Auth_time.IsZero() && aClaims.Auth_time.Before(aNow.Add(-kOpenidAgeMax)) {
+      return nil, tError("OpenID id_token too old")
+   }
+   if iNonce != "" && aClaims.Nonce != iNonce {
+      return nil, tError("OpenID id_token nonce invalid")
+   }
 
    var aCfg *tOpenidCfg
-   for a := range sOpenidCfg {
-      if sOpenidCfg[a].iss == aClaims.Iss && sOpenidCfg[a].aud == aClaims.Aud {
-         aCfg = &sOpenidCfg[a]
+   sOpenidDoor.RLock()
+   for _, aC := range sOpenidCfg {
+      if aC.iss == aClaims.Iss && aClaims.Aud.has(aC.aud) {
+         aCfg = aC
          break
       }
    }
-   if aCfg == nil {
+   sOpenidDoor.RUnlock()
+   if aCfg == nil || aClaims.Azp != "" && aClaims.Azp != aCfg.aud {
       return nil, tError("OpenID id_token claims invalid")
    }
 
-   var aPk *rsa.PublicKey
-   for a := range aCfg.keys {
-      if aCfg.keys[a].Kid == aHead.Kid && aCfg.keys[a].Alg == aHead.Alg {
-         aPk = &rsa.PublicKey{N: (*big.Int)(aCfg.keys[a].N), E: int(aCfg.keys[a].E)}
-         break
-      }
-   }
-   if aPk == nil {
-      return nil, tError("OpenID key not found; restart to reload keys")
+   aKey := aCfg.getKey(aHead.Kid, aHead.Alg)
+   if aKey == nil {
+      return nil, tError("OpenID key not found")
    }
-
-   err = rsa.VerifyPKCS1v15(aPk, crypto.SHA256, aHash.Sum(nil), aSet[2])
-   if err != nil {
+   if !aKey.verify(aHead.Alg, aInput, aSet[2]) {
       return nil, tError("OpenID id_token signature invalid")
    }
-   aMsg := tMsg{"Subject": aClaims.Sub, "Issuer": aClaims.Iss, "Audience": aClaims.Aud,
+   aMsg := tMsg{"Subject": aClaims.Sub, "Issuer": aClaims.Iss, "Audience": aCfg.aud,
                 "IssuedAt": aClaims.Iat.Format(time.RFC3339)}
    return aMsg, nil
 }
-
-func enableTestOpenid() *tOpenidToken {
-   aPk, err := rsa.GenerateKey(rand.Reader, 1024)
-   if err != nil { panic(err) }
-
-   aKeys := struct { Keys []tMsg `json:"keys"` }{ []tMsg{{"alg":"RS256", "kid":"kid"}} }
-   aBuf := make([]byte, 4)
-   binary.LittleEndian.PutUint32(aBuf, uint32(aPk.E))
-   if aBuf[3] == 0 { aBuf = aBuf[:3] }
-   aKeys.Keys[0]["e"] = base64.RawURLEncoding.EncodeToString(aBuf)
-   aKeys.Keys[0]["n"] = base64.RawURLEncoding.EncodeToString(aPk.N.Bytes())
-
-   go func() {
-      http.HandleFunc("/keys", func(cResp http.ResponseWriter, cReq *http.Request) {
-         cResp.Header().Set("Content-Type", "application/json")
-         err := json.NewEncoder(cResp).Encode(&aKeys)
-         if err != nil {
-            fmt.Fprintf(os.Stderr, "OpenID keys test: %v\n", err)
-         }
-      })
-      err := http.ListenAndServe(":8080", nil) //todo enable command-line option for port
-      if err != http.ErrServerClosed {
-         fmt.Fprintf(os.Stderr, "OpenID keys test: %v\n", err)
-      }
-   }()
-
-   aIdH := tMsg{"kid":"kid", "alg":"RS256"}
-   aIdC := tMsg{"sub":"subject", "iss":"issuer", "aud":"audience",
-                "exp": time.Now().Add(time.Minute).Unix()}
-   aTok := tOpenidToken{Token_type:"Bearer", Expires_in:3600, Access_token:"access"}
-
-   aBuf, err = json.Marshal(&aIdH)
-   if err != nil { panic(err) }
-   aTok.Id_token = base64.RawURLEncoding.EncodeToString(aBuf)
-
-   aBuf, err = json.Marshal(&aIdC)
-   if err != nil { panic(err) }
-   aTok.Id_token += "." + base64.RawURLEncoding.EncodeToString(aBuf)
-
-   aHash := sha256.New()
-   aHash.Write([]byte(aTok.Id_token))
-   aBuf, err = rsa.SignPKCS1v15(nil, aPk, crypto.SHA256, aHash.Sum(nil))
-   if err != nil { panic(err) }
-   aTok.Id_token += "." + base64.RawURLEncoding.EncodeToString(aBuf)
-
-   return &aTok
-}
@@ -0,0 +1,135 @@
+// Copyright 2026 Liam Breck
+// Published at https://github.com/networkimprov/mnm
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package qlib
+
+import (
+   "crypto/rand"
+   "crypto/sha256"
+   "sync"
+   "time"
+)
+
+// A pairing code lets a new device obtain a node for a user, without a logged-in node
+// relaying the node id. A logged-in node requests the code, and the user enters it on
+// the new device, which presents it with the user's uid on an unauthenticated link. A node
+// may have one code, replacing any prior one; a code is good for one use within kPairLife.
+// Codes are kept only in memory, indexed by hash, so a restart or dropped node revokes them.
+// The code is short, since it's typed by hand; a wrong guess ends the link. After kPairMissMax
+// wrong guesses for a user, its codes are revoked. After kPairMissFree wrong guesses from an
+// address, it must wait a second before its next try, twice as long after each further one.
+
+const kPairLen = 5
+const kPairLife = 10 * time.Minute
+const kPairMissMax = 5 // wrong guesses for a user with codes, before they're revoked
+const kPairMissFree = 3 // wrong guesses from an address before it must wait
+const kPairWaitMax = kPairLife // longest wait for an address; its misses are forgotten after this
+
+type tPairKey [sha256.Size]byte
+
+type tPair struct {
+   uid, node string // node's queue is copied to the new one
+   label string // user label for the new node
+   expires time.Time
+}
+
+type tPairMiss struct {
+   count int
+   last time.Time
+}
+
+var sPair = struct {
+   sync.Mutex
+   code map[tPairKey]tPair
+   node map[string]tPairKey // indexed by node id
+   userMiss map[string]int // wrong guesses since user's latest code, indexed by uid
+   addrMiss map[string]*tPairMiss // indexed by address
+   pruned time.Time // when stale addrMiss entries were last removed
+}{ code: make(map[tPairKey]tPair), node: make(map[string]tPairKey),
+   userMiss: make(map[string]int), addrMiss: make(map[string]*tPairMiss) }
+
+func makePair(iUid, iNode, iLabel string) string {
+   aData := make([]byte, kPairLen)
+   _, err := rand.Read(aData)
+   if err != nil { panic(err) }
+   aKey := tPairKey(sha256.Sum256(aData))
+   sPair.Lock(); defer sPair.Unlock()
+   if aOld, ok := sPair.node[iNode]; ok {
+      delete(sPair.code, aOld)
+   }
+   sPair.code[aKey] = tPair{uid: iUid, node: iNode, label: iLabel, expires: time.Now().Add(kPairLife)}
+   sPair.node[iNode] = aKey
+   delete(sPair.userMiss, iUid)
+   return sBase32.EncodeToString(aData)
+}
+
+// return pairing for user's code, and revoke it; iAddr is the requester's address
+func usePair(iUid string, iCode []byte, iAddr string) (tPair, error) {
+   aKey := tPairKey(sha256.Sum256(iCode))
+   sPair.Lock(); defer sPair.Unlock()
+   aNow := time.Now()
+   if aNow.Sub(sPair.pruned) >= kPairLife {
+      for aA, aM := range sPair.addrMiss {
+         if aNow.Sub(aM.last) >= kPairWaitMax { delete(sPair.addrMiss, aA) }
+      }
+      sPair.pruned = aNow
+   }
+   aMiss := sPair.addrMiss[iAddr]
+   if aMiss != nil && aMiss.count >= kPairMissFree {
+      aWait := time.Second << uint(aMiss.count - kPairMissFree)
+      if aWait > kPairWaitMax || aWait <= 0 { aWait = kPairWaitMax }
+      if aNow.Sub(aMiss.last) < aWait {
+         return tPair{}, tError("pairing attempt too soon after wrong code")
+      }
+   }
+   aPair, ok := sPair.code[aKey]
+   if !ok || aPair.uid != iUid {
+      if aMiss == nil {
+         aMiss = &tPairMiss{}
+         sPair.addrMiss[iAddr] = aMiss
+      }
+      aMiss.count++
+      aMiss.last = aNow
+      _missPair(iUid)
+      return tPair{}, tError("pairing code invalid")
+   }
+   delete(sPair.code, aKey)
+   delete(sPair.node, aPair.node)
+   delete(sPair.userMiss, iUid)
+   if aNow.After(aPair.expires) {
+      return tPair{}, tError("pairing code expired")
+   }
+   return aPair, nil
+}
+
+// count wrong guess for user, if it has codes, and revoke them at kPairMissMax; sPair is locked
+func _missPair(iUid string) {
+   var aNodes []string
+   for aNode, aKey := range sPair.node {
+      if sPair.code[aKey].uid == iUid { aNodes = append(aNodes, aNode) }
+   }
+   if len(aNodes) == 0 {
+      return
+   }
+   sPair.userMiss[iUid]++
+   if sPair.userMiss[iUid] < kPairMissMax {
+      return
+   }
+   delete(sPair.userMiss, iUid)
+   for _, aNode := range aNodes {
+      delete(sPair.code, sPair.node[aNode])
+      delete(sPair.node, aNode)
+   }
+}
+
+func dropPair(iNode string) {
+   sPair.Lock(); defer sPair.Unlock()
+   if aKey, ok := sPair.node[iNode]; ok {
+      delete(sPair.code, aKey)
+      delete(sPair.node, iNode)
+   }
+}
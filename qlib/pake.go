@@ -0,0 +1,176 @@
+// Copyright 2026 Liam Breck
+// Published at https://github.com/networkimprov/mnm
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package qlib
+
+import (
+   "crypto/rand"
+   "crypto/sha256"
+   "crypto/subtle"
+   "math/big"
+)
+
+// Node login via SRP-6a, an augmented PAKE: the client generates the node secret, and
+// the server stores only a salt & verifier, so it never sees the secret.
+// Group is RFC 5054 2048-bit, hash is SHA-256, and values are padded to the length of N.
+//   k = H(N | g)              x = H(salt | H(secret))     v = g^x
+//   A = g^a                   B = k*v + g^b               u = H(A | B)
+//   S = (A * v^u)^b = (B - k*g^x)^(a + u*x)               K = H(S)
+//   M1 = H(A | B | K)         M2 = H(A | M1 | K)
+// OPAQUE would also hide the salt, but needs a prime-order group with hash-to-curve,
+// which the standard library lacks.
+
+const kPakeMech = "srp6a-2048-sha256"
+const kPakeRefMark = "p" // prefix of PAKE node ref; not in sBase32 alphabet
+const kPakeSaltMin, kPakeSaltMax = 16, 64
+
+var sPakeN, _ = new(big.Int).SetString(
+   "AC6BDB41324A9A9BF166DE5E1389582FAF72B6651987EE07FC3192943DB56050" +
+   "A37329CBB4A099ED8193E0757767A13DD52312AB4B03310DCD7F48A9DA04FD50" +
+   "E8083969EDB767B0CF6095179A163AB3661A05FBD5FAAAE82918A9962F0B93B8" +
+   "55F97993EC975EEAA80D740ADBF4FF747359D041D5C33EA71D281E446B14773B" +
+   "CA97B43A23FB801676BD207A436C6481F1D2B9078717461A5B9D32E688F87748" +
+   "544523B524B0D57D5EA77A2775D2ECFA032CFBDBF52FB3786160279004E57AE6" +
+   "AF874E7303CE53299CCC041C7BC308D82A5698F3A8D0C38271AE35F8E9DBFBB6" +
+   "94B5C803D89F7AE435DE236D525F54759B65E372FCD68EF20FA7111F9E4AFF73", 16)
+var sPakeG = big.NewInt(2)
+var sPakeK = new(big.Int).SetBytes(_pakeHash(sPakeN.Bytes(), _pakePad(sPakeG)))
+
+type tPakeLogin struct { // state of a login between its two requests
+   uid, node string
+   m1, m2 []byte
+}
+
+func makeNodeRef() string {
+   aData := make([]byte, 20)
+   _, err := rand.Read(aData)
+   if err != nil { panic(err) }
+   return kPakeRefMark + sBase32.EncodeToString(aData)
+}
+
+func isNodeRef(iNode string) bool {
+   return len(iNode) > 0 && iNode[:1] == kPakeRefMark
+}
+
+// decode salt & verifier from client into a record for the user database
+func makePakeRecord(iSalt, iVerifier string) ([]byte, error) {
+   aSalt, err := sBase32.DecodeString(iSalt)
+   if err != nil { return nil, err }
+   if len(aSalt) < kPakeSaltMin || len(aSalt) > kPakeSaltMax {
+      return nil, tError("pakesalt length invalid")
+   }
+   aV, err := _pakeInt(iVerifier)
+   if err != nil { return nil, err }
+   aRec := append([]byte{byte(len(aSalt))}, aSalt...)
+   return append(aRec, _pakePad(aV)...), nil
+}
+
+// compute B from record & client's A; returns state to check client's M1, and "pake" msg
+func pakeChallenge(iRecord []byte, iA string) (*tPakeLogin, tMsg, error) {
+   if len(iRecord) < 1 || len(iRecord) <= int(iRecord[0]) {
+      return nil, nil, tError("pake record corrupt")
+   }
+   aSalt, aV := iRecord[1:1+iRecord[0]], new(big.Int).SetBytes(iRecord[1+iRecord[0]:])
+   aA, err := _pakeInt(iA)
+   if err != nil { return nil, nil, err }
+   aBuf := make([]byte, 32)
+   _, err = rand.Read(aBuf)
+   if err != nil { panic(err) }
+   aSecret := new(big.Int).SetBytes(aBuf)
+   aB := new(big.Int).Mul(sPakeK, aV)
+   aB.Add(aB, new(big.Int).Exp(sPakeG, aSecret, sPakeN)).Mod(aB, sPakeN)
+   aU := new(big.Int).SetBytes(_pakeHash(_pakePad(aA), _pakePad(aB)))
+   if aU.Sign() == 0 {
+      return nil, nil, tError("pake parameter invalid")
+   }
+   aS := new(big.Int).Exp(aV, aU, sPakeN)
+   aS.Mul(aS, aA).Mod(aS, sPakeN).Exp(aS, aSecret, sPakeN)
+   aLogin := &tPakeLogin{}
+   aLogin.m1, aLogin.m2 = _pakeProofs(aA, aB, aS)
+   return aLogin, tMsg{"op":"pake", "salt":sBase32.EncodeToString(aSalt),
+                       "pakeb":sBase32.EncodeToString(_pakePad(aB))}, nil
+}
+
+func (o *tPakeLogin) check(iM1 string) bool {
+   aM1, err := sBase32.DecodeString(iM1)
+   return err == nil && subtle.ConstantTimeCompare(aM1, o.m1) == 1
+}
+
+func _pakeProofs(iA, iB, iS *big.Int) (aM1, aM2 []byte) {
+   aK := _pakeHash(_pakePad(iS))
+   aM1 = _pakeHash(_pakePad(iA), _pakePad(iB), aK)
+   aM2 = _pakeHash(_pakePad(iA), aM1, aK)
+   return aM1, aM2
+}
+
+// decode a group element; rejects 0 mod N
+func _pakeInt(iS string) (*big.Int, error) {
+   aBuf, err := sBase32.DecodeString(iS)
+   if err != nil { return nil, err }
+   if len(aBuf) > len(sPakeN.Bytes()) {
+      return nil, tError("pake parameter too long")
+   }
+   aI := new(big.Int).SetBytes(aBuf)
+   if new(big.Int).Mod(aI, sPakeN).Sign() == 0 {
+      return nil, tError("pake parameter invalid")
+   }
+   return aI, nil
+}
+
+func _pakePad(iI *big.Int) []byte {
+   aBuf := iI.Bytes()
+   aPad := make([]byte, len(sPakeN.Bytes()) - len(aBuf))
+   return append(aPad, aBuf...)
+}
+
+func _pakeHash(iList ...[]byte) []byte {
+   aH := sha256.New()
+   for _, aB := range iList {
+      aH.Write(aB)
+   }
+   return aH.Sum(nil)
+}
+
+// client side, used by testclient
+
+func pakeVerifier(iSecret, iSalt []byte) string {
+   return sBase32.EncodeToString(_pakePad(new(big.Int).Exp(sPakeG, _pakeX(iSecret, iSalt), sPakeN)))
+}
+
+func _pakeX(iSecret, iSalt []byte) *big.Int {
+   return new(big.Int).SetBytes(_pakeHash(iSalt, _pakeHash(iSecret)))
+}
+
+type tPakeClient struct {
+   secret []byte
+   a, aA *big.Int
+}
+
+func newPakeClient(iSecret []byte) (*tPakeClient, string) {
+   aBuf := make([]byte, 32)
+   _, err := rand.Read(aBuf)
+   if err != nil { panic(err) }
+   o := &tPakeClient{secret: iSecret, a: new(big.Int).SetBytes(aBuf)}
+   o.aA = new(big.Int).Exp(sPakeG, o.a, sPakeN)
+   return o, sBase32.EncodeToString(_pakePad(o.aA))
+}
+
+// compute M1 to send, and M2 expected from server
+func (o *tPakeClient) proofs(iSalt, iB string) (aM1, aM2 string, err error) {
+   aSalt, err := sBase32.DecodeString(iSalt)
+   if err != nil { return "", "", err }
+   aB, err := _pakeInt(iB)
+   if err != nil { return "", "", err }
+   aU := new(big.Int).SetBytes(_pakeHash(_pakePad(o.aA), _pakePad(aB)))
+   aX := _pakeX(o.secret, aSalt)
+   aS := new(big.Int).Exp(sPakeG, aX, sPakeN)
+   aS.Mul(aS, sPakeK).Sub(aB, aS).Mod(aS, sPakeN)
+   aE := new(big.Int).Mul(aU, aX)
+   aS.Exp(aS, aE.Add(aE, o.a), sPakeN)
+   aM1b, aM2b := _pakeProofs(o.aA, aB, aS)
+   return sBase32.EncodeToString(aM1b), sBase32.EncodeToString(aM2b), nil
+}
@@ -8,17 +8,19 @@
 package qlib
 
 import (
+   "bufio"
+   "bytes"
    "sync/atomic"
    "encoding/base32"
    "hash/crc32"
    "fmt"
    "io"
+   "io/ioutil"
    "encoding/json"
    "net"
    "os"
    "crypto/rand"
    "crypto/sha1"
-   "crypto/sha256"
    "sort"
    "strconv"
    "strings"
@@ -31,11 +33,18 @@ import (
 const kLoginTimeout time.Duration =  5 * time.Second
 const kPulseTimeout time.Duration = 2 * time.Minute
 const kQueueAckTimeout time.Duration = 30 * time.Second
-const kQueueIdleMax time.Duration = 28 * time.Hour
+const kQueueIdleMax time.Duration = 28 * time.Hour // shortest quiet period before reminder or expiry
+const kSweepInterval time.Duration = time.Hour
 const kStoreIdIncr = 1000
 const kPrioDefault byte = 'M'
 const kMsgHeaderMinLen = int64(len(`{"op":1}`))
 const kMsgHeaderMaxLen = int64(1 << 16)
+const kMsgBufLen = 1 << 12 // initial input buffer; grows for long header
+const kChunkHeadLen = 6 // tmtprev 2: two hex digits tag, four hex digits length
+const kChunkMax = 1 << 14 // sent by server; received may be up to 0xffff
+const kTagQueue byte = 1 // tmtprev 2: tag for queue deliveries
+const kTagMax = 16 // tmtprev 2: tags a link may open
+const kTagInMax = 1 << 16 // tmtprev 2: input buffered for a tag before others wait on it
 const kPingCharMax = 140
 const kNodeIdLen = 25
 const kAliasMinLen = 8
@@ -46,6 +55,9 @@ var sSiteName string
 var sAuthType byte
 var sAuthBy []TAuthBy
 var sAuthOptional bool
+var sLimits TLimits
+var sRegisterAuthDoor sync.Mutex // serializes Register with third party authentication
+var sRecoverDoor sync.Mutex
 
 // encoding without vowels to avoid words
 var sBase32 = base32.NewEncoding("%+123456789BCDFGHJKLMNPQRSTVWXYZ")
@@ -55,6 +67,7 @@ var sRecvDoor sync.RWMutex
 var sOhi = tOhi{from: tOhiMap{}}
 var sNode = tNodes{list: tNodeMap{}}
 var sStore = tStore{}
+var sFlag = tFlags{list: tFlagMap{}}
 
 
 type TAuthBy struct {
@@ -68,19 +81,35 @@ type TAuthBy struct {
    Aud   string   `json:",omitempty"` // expected in ID token
 }
 
+type TLimits struct {
+   MsgMax int64 `json:"msgmax"` // data octets in Post, PostNotify, GroupInvite; 0 for no limit
+   Quota  int64 `json:"quota"`  // octets queued per user across its nodes; 0 for no limit
+   QuotaPolicy string `json:"quotapolicy"` // "reject" (default) or "dropold"
+   NodeRemind int `json:"noderemind"` // days a node is quiet before reminders to user's other nodes
+   NodeExpire int `json:"nodeexpire"` // days a node is quiet before it's made defunct
+   AuthMax int `json:"authmax"` // users registered with one third party identity; 0 for 1
+}
+
 type tHeader struct {
    Op uint8
    DataLen, DataHead, NoteLen, NoteHead int64
    DataSum, NoteSum uint64
    Uid, Gid string
    Id string
-   Node, NewNode string
-   NewAlias, From, To string // alias
+   DropUser, Confirm string
+   Node, NewNode, DropNode string
+   NewAlias, DropAlias, From, To string // alias
    Type string
    Act string
    For, NoteFor []tHeaderFor
    ForNotSelf bool
    Oidc *tOpenidToken
+   Pake, PakeSalt, PakeVerifier, PakeA, PakeM string
+   Resume string
+   Recovery string
+   PairNode, PairCode string
+   RotateNode string
+   NewFactor, Factor string
 }
 
 const (
@@ -91,6 +120,12 @@ const (
    eOpPost; eOpPostNotify; eOpPing
    eOpAck
    eOpPulse; eOpQuit
+   eOpSetFlag
+   eOpRecover
+   eOpPair
+   eOpListNodes
+   eOpListLogins
+   eOpReauth
    eOpEnd
 )
 
@@ -101,7 +136,7 @@ const ( _=iota; eForUser; eForGroupAll; eForGroupExcl; eForSelf )
 var sHeaderDefs = [...]tHeader{
    eOpTmtpRev    : { Id:"1" },
    eOpRegister   : { NewNode:"1", NewAlias:"1" }, // Oidc optional
-   eOpLogin      : { Uid:"1", Node:"1" },
+   eOpLogin      : { Uid:"1" }, // Node or Resume; Oidc optional
    eOpUserEdit   : { Id:"1" },
    eOpOhiEdit    : { Id:"1", For:[]tHeaderFor{{}}, Type:"1" },
    eOpGroupInvite: { Id:"1", DataLen:2, Gid:"1", From:"1", To:"1" },
@@ -112,6 +147,12 @@ var sHeaderDefs = [...]tHeader{
    eOpAck        : { Id:"1", Type:"1" },
    eOpPulse      : {  },
    eOpQuit       : {  },
+   eOpSetFlag    : { Id:"1", Type:"1" },
+   eOpRecover    : { NewNode:"1" }, // Uid & Recovery, or Oidc
+   eOpPair       : { Uid:"1", PairCode:"1" },
+   eOpListNodes  : { Id:"1" },
+   eOpListLogins : { Id:"1" },
+   eOpReauth     : { Id:"1" }, // Factor or Oidc
 }
 
 func (o *tHeader) check() bool {
@@ -159,6 +200,8 @@ var sMsgOps = [...]string{
    eOpPost:        "delivery",
    eOpPostNotify:  "delivery",
    eOpPing:        "ping",
+   eOpRecover:     "recovered",
+   eOpPair:        "paired",
    eOpEnd:         "",
 }
 
@@ -178,18 +221,36 @@ var (
    sMsgOpRedundant     = &tMsgQuit{Op:"quit", Error:"disallowed op repetition"}
    sMsgOpDisallowedOff = &tMsgQuit{Op:"quit", Error:"disallowed op on unauthenticated link"}
    sMsgOpDisallowedOn  = &tMsgQuit{Op:"quit", Error:"disallowed op on connected link"}
+   sMsgOpDisallowedTag = &tMsgQuit{Op:"quit", Error:"disallowed op on nonzero tag"}
+   sMsgChunkBad        = &tMsgQuit{Op:"quit", Error:"invalid chunk header"}
+   sMsgChunkTagMax     = &tMsgQuit{Op:"quit", Error:"too many chunk tags"}
    sMsgNeedTmtpRev     = &tMsgQuit{Op:"quit", Error:"tmtprev was omitted"}
+   sMsgPakeOmitted     = &tMsgQuit{Op:"quit", Error:"pake was not negotiated"}
+   sMsgPakeBad         = &tMsgQuit{Op:"quit", Error:"invalid pake parameter"}
    sMsgAuthRequired    = &tMsgQuit{Op:"quit", Error:"authentication required"}
+   sMsgAuthMismatch    = &tMsgQuit{Op:"quit", Error:"authentication does not match user"}
+   sMsgAuthTaken       = &tMsgQuit{Op:"quit", Error:"authentication already registered"}
    sMsgRegisterFailure = &tMsgQuit{Op:"quit", Error:"register failure"} //todo details
    sMsgLoginFailure    = &tMsgQuit{Op:"quit", Error:"login failed"}
+   sMsgRecoverFailure  = &tMsgQuit{Op:"quit", Error:"recovery failed"}
+   sMsgPairFailure     = &tMsgQuit{Op:"quit", Error:"pairing failed"}
+   sMsgReauthFailure   = &tMsgQuit{Op:"quit", Error:"reauthentication failed"}
+   sMsgReauthRequired  = &tMsgQuit{Op:"quit", Error:"disallowed op before reauthentication"}
    sMsgLoginNodeOnline = &tMsgQuit{Op:"quit", Error:"node already connected"}
    sMsgLogout          = &tMsgQuit{Op:"quit", Error:"logout ok"}
+   sMsgNodeDropped     = &tMsgQuit{Op:"quit", Error:"node dropped"}
+   sMsgUserDropped     = &tMsgQuit{Op:"quit", Error:"user dropped"}
    sMsgDatalenHigh     = &tMsgQuit{Op:"quit", Error:"data too long for request type"}
    sMsgDatalenLow      = &tMsgQuit{Op:"quit", Error:"data too short for request type"}
+   sMsgDatalenLimit    = &tMsgQuit{Op:"quit", Error:"data exceeds size limit"}
    sMsgDataNotUtf8     = &tMsgQuit{Op:"quit", Error:"data not valid UTF8"}
    sMsgForEmpty        = &tMsgQuit{Op:"quit", Error:"recipient list empty"}
 )
 
+type tLinkError struct { quit *tMsgQuit } // conveys a quit via a tag's pipe
+
+func (o *tLinkError) Error() string { return o.quit.Error }
+
 func msgConn(iErr net.Error) *tMsgQuit {
    if iErr.Timeout() {
       return sMsgTimeout
@@ -216,6 +277,9 @@ func packMsg(iHead interface{}, iData []byte) []byte {
 type tError string
 func (o tError) Error() string { return string(o) }
 
+var sErrDataSum = tError("datasum does not match data")
+var sErrReauth = tError("reauthentication required")
+
 
 type UserDatabase interface {
    // a UserDatabase stores:
@@ -225,17 +289,34 @@ type UserDatabase interface {
    //   a set of Groups for message distribution
    //   the set of Aliases & Uids for each group
 
-   AddUser(iUid, iNewNode string, iAuth map[string]interface{}) (aQid string, err error)
-   AddNode(iUid, iNewNode string) (aQid string, err error)
+   AddUser(iUid, iNewNode, iLabel string, iPake []byte, iAuth map[string]interface{}) (aQid string, err error)
+   AddNode(iUid, iNewNode, iLabel string, iPake []byte) (aQid string, err error)
    DropNode(iUid, iNode string) (aQid string, err error)
+   DropQid(iUid, iQid string) error
+   ReplaceNode(iUid, iQid, iNewNode string, iPake []byte) error
    AddAlias(iUid, iNat, iEn string) error
    DropAlias(iUid, iAlias string) error
-   //DropUser(iUid string) error
+   DropUser(iUid string) (aQids []string, err error)
+   SetMsgMax(iUid string, iMax int64) error
+   GetMsgMax(iUid string) (aMax int64, err error)
+   GetAuth(iUid string) (aAuth map[string]interface{}, err error)
+   SetNodeLogin(iUid, iQid, iAddr string) (aNew bool, aPrior int64, err error)
+   GetNodes(iUid string) (aNodes []map[string]interface{}, err error)
+   GetLogins(iUid string) (aLogins []map[string]interface{}, err error)
+   GetQuiet(iBefore int64) (aQids map[string]int64, err error)
 
    Verify(iUid, iNode string) (aQid string, err error)
+   VerifyPake(iUid, iRef string) (aQid string, aPake []byte, err error)
+   SetRecovery(iUid, iCode string) error
+   VerifyRecovery(iUid, iCode string) error
+   SetFactor(iUid, iSecret string) error
+   VerifyFactor(iUid, iSecret string) error
+   SetReauth(iUid, iQid string, iDue bool) error
+   GetReauth(iUid, iQid string) (aDue, aFactor bool, err error)
    OpenNodes(iUid string) (aQids []string, err error)
    CloseNodes(iUid string) error
    Lookup(iAlias string) (aUid string, err error)
+   LookupAuth(iIss, iSub string) (aUids []string, err error)
 
    GroupInvite(iGid, iAlias, iByAlias, iByUid string) (aUid string, err error)
    GroupJoin(iGid, iUid, iNewAlias string) (aAlias string, err error)
@@ -252,8 +333,35 @@ type UserDatabase interface {
 }
 
 
-func SetTmtpRev(iName string, iType byte, iBy []TAuthBy) error {
+func SetTmtpRev(iName string, iType byte, iBy []TAuthBy, iLimits TLimits) error {
    sSiteName, sAuthType, sAuthBy, sAuthOptional = iName, iType, iBy, false
+   sLimits = iLimits
+   if sLimits.MsgMax < 0 {
+      return tError("limits.msgmax must be >= 0")
+   }
+   if sLimits.Quota < 0 {
+      return tError("limits.quota must be >= 0")
+   }
+   if sLimits.AuthMax < 0 {
+      return tError("limits.authmax must be >= 0")
+   } else if sLimits.AuthMax == 0 {
+      sLimits.AuthMax = 1
+   }
+   for _, aDays := range [...]int{sLimits.NodeRemind, sLimits.NodeExpire} {
+      if aDays < 0 || aDays != 0 && _days(aDays) < kQueueIdleMax {
+         return tError(fmt.Sprintf("limits.noderemind & nodeexpire must be 0 or >= %v", kQueueIdleMax))
+      }
+   }
+   if sLimits.NodeExpire != 0 && sLimits.NodeExpire <= sLimits.NodeRemind {
+      return tError("limits.nodeexpire must exceed noderemind")
+   }
+   switch sLimits.QuotaPolicy {
+   case "":
+      sLimits.QuotaPolicy = "reject"
+   case "reject", "dropold":
+   default:
+      return tError(`limits.quotapolicy must be "reject" or "dropold"`)
+   }
    if len(sAuthBy) > 26 { // limited by mnm client state parameter
       return tError("too many authentication services (max 26)")
    } else if len(sAuthBy) == 0 {
@@ -264,6 +372,7 @@ func SetTmtpRev(iName string, iType byte, iBy []TAuthBy) error {
    }
    clearConfigOpenid()
    for a := range sAuthBy {
+      aStd := strings.Join(sAuthBy[a].Std, "&")
       if sAuthBy[a].Label == "" {
          return tError(fmt.Sprintf("missing label for authby[%d]", a))
       }
@@ -280,10 +389,13 @@ func SetTmtpRev(iName string, iType byte, iBy []TAuthBy) error {
          }
          aSet[1] = aParams[1:]
       }
+      if sAuthBy[a].Keys == "" && sAuthBy[a].Iss == "" {
+         return tError("missing keys URL or iss for "+ sAuthBy[a].Label)
+      }
       sAuthBy[a].Login = sAuthBy[a].Login[:2]
       sAuthBy[a].Token = sAuthBy[a].Token[:2]
       sAuthBy[a].Std = nil
-      addConfigOpenid(sAuthBy[a].Keys, sAuthBy[a].Iss, sAuthBy[a].Aud)
+      addConfigOpenid(sAuthBy[a].Keys, sAuthBy[a].Iss, sAuthBy[a].Aud, sAuthBy[a].Token[0], aStd)
       sAuthBy[a].Keys, sAuthBy[a].Iss, sAuthBy[a].Aud = "", "", ""
    }
    initOpenid()
@@ -297,11 +409,20 @@ func Suspend() {
 
 type tLink struct { // network client msg handler
    conn net.Conn // link to client
-   expectPulse bool
+   in *tTagIn // tmtprev 2: input for tag
+   tag byte // tmtprev 2: tag of input
+   expectPulse int32 // atomic; read by _runChunks
    queue *tQueue
    tmtprev string
    uid, node string
+   msgmax int64 // data size limit for sender
    ohi *tOhiSet
+   confirm string // one-time code for dropuser
+   pake bool // PAKE login negotiated by tmtprev
+   pakeLogin *tPakeLogin // awaiting client's proof
+   nonce string // for OpenID id_token, given in tmtprev response or reauth challenge
+   reauthAt time.Time // last reauthentication
+   reauthNone bool // login challenge listed no methods, so newfactor is allowed while held
 }
 
 func NewLink(iConn net.Conn) {
@@ -309,9 +430,16 @@ func NewLink(iConn net.Conn) {
 }
 
 func (o *tLink) Read(iBuf []byte) (int, error) {
-   if o.expectPulse {
+   if o.in != nil {
+      return o.in.Read(iBuf)
+   }
+   return o._readConn(iBuf)
+}
+
+func (o *tLink) _readConn(iBuf []byte) (int, error) {
+   if atomic.LoadInt32(&o.expectPulse) != 0 {
       err := o.conn.SetReadDeadline(time.Now().Add(kPulseTimeout))
-      if err != nil { panic(err) }
+      if err != nil { return 0, err } // conn closed by queue.closeLink()
    }
    return o.conn.Read(iBuf)
 }
@@ -324,18 +452,66 @@ func (o *tLink) _logNode() string {
 }
 
 func _runLink(o *tLink) {
-   aBuf := make([]byte, kMsgHeaderMaxLen+4) //todo start smaller, realloc as needed
+   err := o.conn.SetReadDeadline(time.Now().Add(kLoginTimeout))
+   if err != nil { panic(err) }
+
+   aQuitMsg := o._readMsgs()
+
+   if aQuitMsg.Op == "eof" {
+      fmt.Printf("%s - eof\n", o._logNode())
+   } else {
+      fmt.Fprintf(os.Stderr, "%s + %s %s\n", o._logNode(), aQuitMsg.Op, aQuitMsg.Error)
+   }
+   if o.in != nil {
+      o.in.Close() // unblocks _runChunks
+   }
+   if o.queue != nil {
+      sFlag.clear(o.uid, o.node)
+      o.queue.unlink()
+   }
+   if aQuitMsg.Op == "quit" && o.tmtprev != "" {
+      _, err = o.conn.Write(packMsg(aQuitMsg, nil))
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._runLink quit %s\n", o._logNode(), err)
+      }
+   }
+   o.conn.Close()
+   if o.ohi != nil {
+      for _, aUid := range sOhi.unref(o.uid) {
+         aNodes, err := UDb.OpenNodes(aUid)
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "%s link._runLink opennodes %s\n", o._logNode(), err)
+            continue
+         }
+         o._sendOhi(aNodes, eOhiOff)
+         _ = UDb.CloseNodes(aUid)
+      }
+   }
+}
+
+func _runTag(o *tLink) {
+   aQuitMsg := o._readMsgs()
+   o.in.Close()
+   if aQuitMsg.Op == "quit" {
+      fmt.Fprintf(os.Stderr, "%s + tag %d %s %s\n", o._logNode(), o.tag, aQuitMsg.Op, aQuitMsg.Error)
+      o.queue.closeLink(aQuitMsg)
+   }
+}
+
+func (o *tLink) _readMsgs() *tMsgQuit {
+   aBuf := make([]byte, kMsgBufLen)
    var aLen int
    var aPos, aHeadEnd int64
    var aQuitMsg *tMsgQuit
+   var err error
 
-   err := o.conn.SetReadDeadline(time.Now().Add(kLoginTimeout))
-   if err != nil { panic(err) }
    for {
       aLen, err = o.Read(aBuf[aPos:])
       if err != nil {
          if err == io.EOF {
             aQuitMsg = sMsgEof
+         } else if aErr, _ := err.(*tLinkError); aErr != nil {
+            aQuitMsg = aErr.quit
          } else if _, ok := err.(tls.RecordHeaderError); ok {
             aQuitMsg = sMsgTlsRecord
          } else if aErr, _ := err.(net.Error); aErr != nil {
@@ -358,6 +534,9 @@ func _runLink(o *tLink) {
             aQuitMsg = sMsgLengthBad
             break
          }
+         if aNeed := aHeadEnd + kPingCharMax*3; aNeed > int64(len(aBuf)) { // room for _checkPing
+            aBuf = append(aBuf, make([]byte, aNeed - int64(len(aBuf)))...)
+         }
       }
       if aHeadEnd > aPos {
          continue
@@ -377,6 +556,11 @@ func _runLink(o *tLink) {
       if aQuitMsg != nil {
          break
       }
+      if aHead.Op == eOpTmtpRev && o.tmtprev == "2" {
+         o._startChunks(aBuf[aHeadEnd:aPos]) // input after tmtprev is tagged
+         aPos, aHeadEnd = 0,0
+         continue
+      }
       if aPos > aHeadEnd + aHead.DataLen {
          aPos = int64(copy(aBuf, aBuf[aHeadEnd + aHead.DataLen : aPos]))
          aHeadEnd = 0
@@ -384,81 +568,275 @@ func _runLink(o *tLink) {
       }
       aPos, aHeadEnd = 0,0
    }
+   return aQuitMsg
+}
 
-   if aQuitMsg.Op == "eof" {
-      fmt.Printf("%s - eof\n", o._logNode())
-   } else {
-      fmt.Fprintf(os.Stderr, "%s + %s %s\n", o._logNode(), aQuitMsg.Op, aQuitMsg.Error)
-   }
-   if o.queue != nil {
-      o.queue.unlink()
+func (o *tLink) _startChunks(iBuf []byte) {
+   o.in = newTagIn()
+   o.conn = &tChunkConn{Conn: o.conn}
+   go _runChunks(o, append([]byte(nil), iBuf...))
+}
+
+func _runChunks(o *tLink, iBuf []byte) {
+   aRd := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(iBuf), tReaderFunc(o._readConn)),
+                              kChunkHeadLen + 0xffff)
+   aIns := map[byte]*tTagIn{0: o.in}
+   aHead := make([]byte, kChunkHeadLen)
+   var err error
+
+   for {
+      _, err = io.ReadFull(aRd, aHead)
+      if err != nil { break }
+      aTag, err1 := strconv.ParseUint(string(aHead[:2]), 16, 8)
+      aLen, err2 := strconv.ParseUint(string(aHead[2:]), 16, 16)
+      if err1 != nil || err2 != nil || aLen == 0 {
+         err = &tLinkError{sMsgChunkBad}
+         break
+      }
+      aIn := aIns[byte(aTag)]
+      if aIn == nil {
+         if atomic.LoadInt32(&o.expectPulse) == 0 {
+            err = &tLinkError{sMsgOpDisallowedOff}
+            break
+         }
+         if len(aIns) > kTagMax {
+            err = &tLinkError{sMsgChunkTagMax}
+            break
+         }
+         aIn = newTagIn()
+         aIns[byte(aTag)] = aIn
+         go _runTag(&tLink{conn:o.conn, in:aIn, tag:byte(aTag), expectPulse:1,
+                           tmtprev:o.tmtprev, uid:o.uid, node:o.node, msgmax:o.msgmax, queue:o.queue})
+      }
+      aBuf := make([]byte, aLen) // not from aRd, as tag may hold it
+      _, err = io.ReadFull(aRd, aBuf)
+      if err != nil { break }
+      err = aIn.put(aBuf)
+      if err != nil { break }
    }
-   if aQuitMsg.Op == "quit" && o.tmtprev != "" {
-      _, err = o.conn.Write(packMsg(aQuitMsg, nil))
-      if err != nil {
-         fmt.Fprintf(os.Stderr, "%s link._runLink quit %s\n", o._logNode(), err)
+   for aTag, aIn := range aIns {
+      if aTag == 0 {
+         aIn.CloseWithError(err)
+      } else {
+         aIn.CloseWithError(io.EOF)
       }
    }
-   o.conn.Close()
-   if o.ohi != nil {
-      for _, aUid := range sOhi.unref(o.uid) {
-         aNodes, err := UDb.OpenNodes(aUid)
-         if err != nil {
-            fmt.Fprintf(os.Stderr, "%s link._runLink opennodes %s\n", o._logNode(), err)
-            continue
-         }
-         o._sendOhi(aNodes, eOhiOff)
-         _ = UDb.CloseNodes(aUid)
+}
+
+type tTagIn struct { // tmtprev 2: buffers input for a tag, so a slow tag rarely stalls others
+   door sync.Mutex
+   change *sync.Cond
+   buf [][]byte
+   len int
+   err error // from _runChunks, after buf is read
+   closed bool // by reader
+}
+
+func newTagIn() *tTagIn {
+   aIn := &tTagIn{}
+   aIn.change = sync.NewCond(&aIn.door)
+   return aIn
+}
+
+// waits while tag has kTagInMax unread
+func (o *tTagIn) put(iBuf []byte) error {
+   o.door.Lock(); defer o.door.Unlock()
+   for o.len >= kTagInMax && !o.closed {
+      o.change.Wait()
+   }
+   if o.closed {
+      return io.ErrClosedPipe
+   }
+   o.buf = append(o.buf, iBuf)
+   o.len += len(iBuf)
+   o.change.Broadcast()
+   return nil
+}
+
+func (o *tTagIn) Read(iBuf []byte) (int, error) {
+   o.door.Lock(); defer o.door.Unlock()
+   for len(o.buf) == 0 {
+      if o.err != nil || o.closed {
+         if o.closed { return 0, io.ErrClosedPipe }
+         return 0, o.err
       }
+      o.change.Wait()
+   }
+   aLen := copy(iBuf, o.buf[0])
+   o.buf[0] = o.buf[0][aLen:]
+   if len(o.buf[0]) == 0 {
+      o.buf[0] = nil
+      o.buf = o.buf[1:]
+   }
+   o.len -= aLen
+   o.change.Broadcast()
+   return aLen, nil
+}
+
+// for reader; unblocks _runChunks
+func (o *tTagIn) Close() error {
+   o.door.Lock(); defer o.door.Unlock()
+   o.closed, o.buf, o.len = true, nil, 0
+   o.change.Broadcast()
+   return nil
+}
+
+// for _runChunks; iErr nil yields io.EOF
+func (o *tTagIn) CloseWithError(iErr error) error {
+   if iErr == nil { iErr = io.EOF }
+   o.door.Lock(); defer o.door.Unlock()
+   if o.err == nil { o.err = iErr }
+   o.change.Broadcast()
+   return nil
+}
+
+type tReaderFunc func([]byte) (int, error)
+
+func (o tReaderFunc) Read(iBuf []byte) (int, error) { return o(iBuf) }
+
+type tChunkConn struct { // tmtprev 2: frames output in tagged chunks
+   net.Conn
+}
+
+func (o *tChunkConn) Write(iBuf []byte) (int, error) { return o.writeTag(0, iBuf) }
+
+func (o *tChunkConn) writeTag(iTag byte, iBuf []byte) (int, error) {
+   aLen := 0
+   for aLen < len(iBuf) {
+      aEnd := aLen + kChunkMax; if aEnd > len(iBuf) { aEnd = len(iBuf) }
+      aChunk := make([]byte, 0, kChunkHeadLen + aEnd - aLen)
+      aChunk = append(aChunk, fmt.Sprintf("%02x%04x", iTag, aEnd - aLen)...)
+      aChunk = append(aChunk, iBuf[aLen:aEnd]...)
+      _, err := o.Conn.Write(aChunk)
+      if err != nil { return aLen, err }
+      aLen = aEnd
    }
+   return aLen, nil
 }
 
 func (o *tLink) _handleMsg(iHead *tHeader, iData []byte) *tMsgQuit {
+   var aMark string // for eOpSetFlag; put to queue after sRecvDoor is released, as put may wait
+   defer func() { if aMark != "" { o.queue.put(aMark) } }() // ack sent when queue reaches mark
    sRecvDoor.RLock(); defer sRecvDoor.RUnlock()
    var err error
    var aMid, aPosted string
 
+   if o.tag != 0 {
+      switch iHead.Op {
+      case eOpPost, eOpPostNotify, eOpPing, eOpGroupInvite, eOpAck, eOpPulse:
+      default:
+         return sMsgOpDisallowedTag
+      }
+   }
+   switch iHead.Op {
+   case eOpPost, eOpPostNotify, eOpGroupInvite:
+      if o.msgmax > 0 && iHead.DataLen > o.msgmax { return sMsgDatalenLimit } // data not yet read
+   }
+
+   switch iHead.Op {
+   case eOpRegister, eOpUserEdit, eOpRecover, eOpPair:
+      if (iHead.PakeSalt == "") != (iHead.PakeVerifier == "") { return sMsgHeaderBad }
+      if iHead.PakeVerifier != "" && !o.pake { return sMsgPakeOmitted }
+      if iHead.Resume != "" { return sMsgHeaderBad }
+      if iHead.Op == eOpRecover && (iHead.Recovery == "") == (iHead.Oidc == nil) { return sMsgHeaderBad }
+      if iHead.Op == eOpRecover && iHead.Uid == "" && iHead.Oidc == nil { return sMsgHeaderBad }
+   case eOpReauth:
+      if (iHead.Factor == "") == (iHead.Oidc == nil) { return sMsgHeaderBad }
+   case eOpLogin:
+      if (iHead.Node == "") == (iHead.Resume == "") { return sMsgHeaderBad }
+      if iHead.Resume != "" && (iHead.PakeA != "" || iHead.PakeM != "") { return sMsgHeaderBad }
+      if iHead.PakeA != "" && iHead.PakeM != "" { return sMsgHeaderBad }
+      if (iHead.PakeA != "" || iHead.PakeM != "") && !o.pake { return sMsgPakeOmitted }
+   }
+
    switch iHead.Op {
    case eOpTmtpRev:
       if o.tmtprev != "" { return sMsgOpRedundant }
-   case eOpRegister, eOpLogin:
+   case eOpRegister, eOpLogin, eOpRecover, eOpPair:
       if o.tmtprev == "" { return sMsgNeedTmtpRev }
       if o.node    != "" { return sMsgOpDisallowedOn }
    default:
       if o.node    == "" { return sMsgOpDisallowedOff }
    }
 
+   if o.queue != nil && atomic.LoadInt32(&o.queue.held) != 0 {
+      switch iHead.Op {
+      case eOpReauth, eOpPulse, eOpQuit:
+      case eOpUserEdit:
+         if iHead.NewFactor == "" || !o.reauthNone { return sMsgReauthRequired }
+      default:
+         return sMsgReauthRequired
+      }
+   } else if o.queue != nil {
+      if aMsg := o._reauthOp(iHead); aMsg != nil {
+         o.queue.ackAsap(iHead.Id, "", "", tMsg{"reauth":aMsg}, sErrReauth)
+         return nil
+      }
+   }
+
    switch iHead.Op {
    case eOpTmtpRev:
       switch iHead.Id {
-      case "1":
+      case "1", "2":
          o.tmtprev = iHead.Id
       default:
          o.tmtprev = "1"
       }
       aRev := tMsg{"op":"tmtprev", "id":o.tmtprev, "name":sSiteName}
+      if iHead.Pake == kPakeMech {
+         o.pake = true
+         aRev["pake"] = kPakeMech
+      }
+      if sLimits.MsgMax > 0 {
+         aRev["msgmax"] = sLimits.MsgMax
+      }
+      o.nonce = makeNonceOpenid() // so a token from client is always checked
       if sAuthType != 0 {
-         aRev["auth"], aRev["authby"] = sAuthType, sAuthBy
+         aRev["auth"], aRev["authby"], aRev["nonce"] = sAuthType, sAuthBy, o.nonce
       }
       o.conn.Write(packMsg(aRev, nil))
    case eOpRegister:
       var aAuthData tMsg
       if len(sAuthBy) > 0 && (!sAuthOptional || iHead.Oidc != nil) {
          if iHead.Oidc == nil { return sMsgAuthRequired }
-         aAuthData, err = validateTokenOpenid(iHead.Oidc)
+         aAuthData, err = validateTokenOpenid(iHead.Oidc, o.nonce)
          if err != nil {
             fmt.Fprintf(os.Stderr, "%s link._handleMsg register %s\n", o._logNode(), err)
             return sMsgAuthRequired
          }
       }
       aUid := makeUid()
-      aNodeId, aNodeSha := makeNodeId()
-      _, err = UDb.AddUser(aUid, aNodeSha, aAuthData) //todo iHead.NewNode
+      aNodeId, aNodeKey, aPake, aErr := makeNode(iHead.PakeSalt, iHead.PakeVerifier)
+      if aErr != nil {
+         return sMsgPakeBad
+      }
+      if aAuthData != nil {
+         sRegisterAuthDoor.Lock() // count & add must not interleave with another register
+         var aUids []string
+         aUids, err = UDb.LookupAuth(aAuthData["Issuer"].(string), aAuthData["Subject"].(string))
+         if err == nil && len(aUids) >= sLimits.AuthMax {
+            sRegisterAuthDoor.Unlock()
+            return sMsgAuthTaken
+         }
+      }
+      if err == nil {
+         _, err = UDb.AddUser(aUid, aNodeKey, iHead.NewNode, aPake, aAuthData)
+      }
+      if aAuthData != nil {
+         sRegisterAuthDoor.Unlock()
+      }
       if err != nil {
          fmt.Fprintf(os.Stderr, "%s link._handleMsg register %s\n", o._logNode(), err)
          return sMsgRegisterFailure
       }
       aAck := tMsg{"op":sMsgOps[iHead.Op], "uid":aUid, "nodeid":aNodeId}
+      aCode, aRecovery := makeRecovery()
+      err = UDb.SetRecovery(aUid, aRecovery)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._handleMsg register %s\n", o._logNode(), err)
+      } else {
+         aAck["recovery"] = aCode
+      }
       if iHead.NewAlias != "_" {
          if len(iHead.NewAlias) < kAliasMinLen { //todo enforce in userdb
             aAck["error"] = fmt.Sprintf("newalias must be %d+ characters", kAliasMinLen)
@@ -474,34 +852,142 @@ func (o *tLink) _handleMsg(iHead *tHeader, iData []byte) *tMsgQuit {
       iHead.Node = aNodeId
       fallthrough
    case eOpLogin:
-      var aNodeSha, aQid string
-      aNodeSha, err = getNodeSha(&iHead.Node)
+      if iHead.PakeA != "" {
+         var aPake []byte
+         _, aPake, err = UDb.VerifyPake(iHead.Uid, iHead.Node)
+         if err != nil {
+            return sMsgLoginFailure
+         }
+         var aMsg tMsg
+         o.pakeLogin, aMsg, err = pakeChallenge(aPake, iHead.PakeA)
+         if err != nil {
+            return sMsgPakeBad
+         }
+         o.pakeLogin.uid, o.pakeLogin.node = iHead.Uid, iHead.Node
+         o.conn.Write(packMsg(aMsg, nil))
+         break
+      }
+      var aQid string
+      var aPakeM2 []byte
+      if iHead.PakeM != "" {
+         aLogin := o.pakeLogin
+         o.pakeLogin = nil
+         if aLogin == nil || aLogin.uid != iHead.Uid || aLogin.node != iHead.Node ||
+            !aLogin.check(iHead.PakeM) {
+            return sMsgLoginFailure
+         }
+         aPakeM2 = aLogin.m2
+         aQid, _, err = UDb.VerifyPake(iHead.Uid, iHead.Node)
+      } else if iHead.Op == eOpRegister && isNodeRef(iHead.Node) {
+         aQid, _, err = UDb.VerifyPake(iHead.Uid, iHead.Node)
+      } else if iHead.Resume != "" {
+         var aToken []byte
+         aToken, err = sBase32.DecodeString(iHead.Resume)
+         if err != nil {
+            return sMsgBase32Bad
+         }
+         aQid, err = useResume(iHead.Uid, aToken)
+      } else {
+         var aSecret string
+         aSecret, err = getNodeSecret(&iHead.Node)
+         if err != nil {
+            return sMsgBase32Bad
+         }
+         aQid, err = UDb.Verify(iHead.Uid, aSecret)
+      }
       if err != nil {
-         return sMsgBase32Bad
+         return sMsgLoginFailure
       }
-      aQid, err = UDb.Verify(iHead.Uid, aNodeSha)
+      var aRefresh string
+      if sAuthType == 2 && iHead.Op == eOpLogin && (!sAuthOptional || iHead.Oidc != nil) {
+         var aQuit *tMsgQuit
+         aRefresh, aQuit = o._checkAuth(iHead.Uid, iHead.Oidc)
+         if aQuit != nil { return aQuit }
+      }
+      var aMax int64
+      aMax, err = UDb.GetMsgMax(iHead.Uid)
       if err != nil {
          return sMsgLoginFailure
       }
-      aQ := queueLink(aQid, o.conn, tMsg{"op":"info", "info":"login ok", "ohi":nil}, iHead.Uid)
+      aInfo := tMsg{"op":"info", "info":"login ok", "ohi":nil, "resume":makeResume(iHead.Uid, aQid)}
+      if aPakeM2 != nil {
+         aInfo["pakem"] = sBase32.EncodeToString(aPakeM2)
+      }
+      if aRefresh != "" {
+         aInfo["oidcrefresh"] = aRefresh
+      }
+      o.msgmax = sLimits.MsgMax
+      if aMax > 0 && (sLimits.MsgMax == 0 || aMax < sLimits.MsgMax) { // may only lower site limit
+         o.msgmax = aMax
+         aInfo["msgmax"] = aMax
+      }
+      if sLimits.Quota > 0 {
+         aInfo["quota"] = sLimits.Quota
+         aInfo["quotaused"] = sStore.getUsage(iHead.Uid)
+      }
+      aAddr, _, _ := net.SplitHostPort(o.conn.RemoteAddr().String())
+      var aNewAddr, aDue, aFactor bool
+      var aPrior int64
+      aNewAddr, aPrior, err = UDb.SetNodeLogin(iHead.Uid, aQid, aAddr) // before queueLink, for policy
+      if err == nil && iHead.Op == eOpLogin {
+         aDue, aFactor, err = UDb.GetReauth(iHead.Uid, aQid)
+      }
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._handleMsg login %s\n", o._logNode(), err)
+      }
+      var aWhy string
+      if iHead.Op == eOpLogin {
+         aWhy = reauthLogin(aDue, aNewAddr, aPrior)
+      }
+      if aWhy != "" {
+         aInfo["reauth"] = o._reauthChallenge(iHead.Uid, aFactor, aWhy)
+         o.reauthNone = len(aInfo["reauth"].(tMsg)["by"].([]string)) == 0
+      }
+      aQ := queueLink(aQid, o.conn, aInfo, iHead.Uid, aWhy != "")
       if aQ == nil {
          return sMsgLoginNodeOnline
       }
-      o.expectPulse = true
       o.uid = iHead.Uid
       o.node = aQid
       o.queue = aQ
+      atomic.StoreInt32(&o.expectPulse, 1) // after fields read by _runChunks
       if iHead.Op != eOpRegister {
+         aNum, _ := strconv.ParseUint(o.node[strings.LastIndexByte(o.node, '.')+1:], 16, 8)
+         aEtc := tMsg{"node":aNum, "addr":aAddr}
+         if aNewAddr {
+            aEtc["newaddr"] = true
+         }
+         if aWhy != "" {
+            aEtc["reauth"] = aWhy
+         }
          iHead.For = []tHeaderFor{{Id:o.uid, Type:eForUser}}
-         _, _, err = o._postMsg(iHead, tMsg{"node":"tbd"}, nil) //todo tbd=noderef
+         _, _, err = o._postMsg(iHead, aEtc, nil)
          if err != nil { panic(err) }
       }
       fmt.Printf("%s - login %s\n", o._logNode(), o.conn.RemoteAddr().String())
+   case eOpRecover:
+      aQuit := o._recover(iHead)
+      if aQuit != nil { return aQuit }
+   case eOpPair:
+      aQuit := o._pair(iHead)
+      if aQuit != nil { return aQuit }
+   case eOpReauth:
+      aQuit := o._reauth(iHead)
+      if aQuit != nil { return aQuit }
    case eOpUserEdit:
-      if iHead.NewNode == "" && iHead.NewAlias == "" { return sMsgHeaderBad }
-      if iHead.NewNode != "" && iHead.NewAlias != "" { return sMsgHeaderBad }
-      var aEtc tMsg
-      if iHead.NewAlias != "" {
+      aN := 0
+      for _, aS := range [...]string{iHead.NewNode, iHead.NewAlias, iHead.DropNode, iHead.DropAlias,
+                                     iHead.DropUser, iHead.PairNode, iHead.RotateNode, iHead.NewFactor} {
+         if aS != "" { aN++ }
+      }
+      aRenew := iHead.PakeVerifier != "" && iHead.NewNode == "" && iHead.PairNode == "" &&
+                iHead.RotateNode == "" // re-register this node with PAKE record
+      if aRenew { aN++ }
+      if aN != 1 { return sMsgHeaderBad }
+      var aEtc, aAckEtc tMsg
+      var aDropQids []string
+      switch {
+      case iHead.NewAlias != "":
          if len(iHead.NewAlias) < kAliasMinLen {
             err = tError(fmt.Sprintf("newalias must be %d+ characters", kAliasMinLen))
          } else {
@@ -510,24 +996,123 @@ func (o *tLink) _handleMsg(iHead *tHeader, iData []byte) *tMsgQuit {
                aEtc = tMsg{"newalias": iHead.NewAlias}
             }
          }
-      } else {
-         aNodeId, aNodeSha := makeNodeId()
+      case iHead.NewNode != "":
+         aNodeId, aNodeKey, aPake, aErr := makeNode(iHead.PakeSalt, iHead.PakeVerifier)
+         if aErr != nil {
+            return sMsgPakeBad
+         }
          var aQid string
-         aQid, err = UDb.AddNode(o.uid, aNodeSha)
+         aQid, err = UDb.AddNode(o.uid, aNodeKey, iHead.NewNode, aPake)
          if err == nil {
             err = sStore.copyDir(o.node, aQid)
             if err != nil { panic(err) }
             aEtc = tMsg{"nodeid": aNodeId, "newnode": iHead.NewNode}
          }
+      case iHead.PairNode != "":
+         if iHead.PakeVerifier != "" { return sMsgHeaderBad } // given by new node
+         aAckEtc = tMsg{"paircode": makePair(o.uid, o.node, iHead.PairNode)}
+      case iHead.RotateNode != "":
+         var aQid string
+         if isNodeRef(iHead.RotateNode) {
+            aQid, _, err = UDb.VerifyPake(o.uid, iHead.RotateNode)
+         } else {
+            var aSecret string
+            aSecret, err = getNodeSecret(&iHead.RotateNode)
+            if err != nil {
+               return sMsgBase32Bad
+            }
+            aQid, err = UDb.Verify(o.uid, aSecret)
+         }
+         if err == nil && aQid != o.node {
+            err = tError("rotatenode must give sender's node")
+         }
+         if err != nil { break }
+         aNodeId, aNodeKey, aPake, aErr := makeNode(iHead.PakeSalt, iHead.PakeVerifier)
+         if aErr != nil {
+            return sMsgPakeBad
+         }
+         err = UDb.ReplaceNode(o.uid, o.node, aNodeKey, aPake)
+         if err == nil {
+            dropResume(o.node)
+            aAckEtc = tMsg{"nodeid": aNodeId}
+            aNum, _ := strconv.ParseUint(o.node[strings.LastIndexByte(o.node, '.')+1:], 16, 8)
+            aHead := &tHeader{Op: eOpUserEdit} // no .For, so only to sender's other nodes
+            _, _, err = o._postMsg(aHead, tMsg{"rotatednode": aNum}, nil)
+         }
+      case aRenew:
+         aNodeId, _, aPake, aErr := makeNode(iHead.PakeSalt, iHead.PakeVerifier)
+         if aErr != nil {
+            return sMsgPakeBad
+         }
+         err = UDb.ReplaceNode(o.uid, o.node, aNodeId, aPake)
+         if err == nil {
+            aAckEtc = tMsg{"nodeid": aNodeId}
+         }
+      case iHead.NewFactor != "":
+         err = UDb.SetFactor(o.uid, iHead.NewFactor)
+         if err == nil {
+            aEtc = tMsg{"newfactor": true}
+            o.reauthNone = false // user may now Reauth
+         }
+      case iHead.DropAlias != "":
+         err = UDb.DropAlias(o.uid, iHead.DropAlias)
+         if err == nil {
+            aEtc = tMsg{"dropalias": iHead.DropAlias}
+         }
+      case iHead.DropNode != "":
+         if aNum, aErr := strconv.ParseUint(iHead.DropNode, 10, 8); aErr == nil { // from ListNodes
+            aQid := fmt.Sprintf("%s.%02x", o.uid, aNum)
+            err = UDb.DropQid(o.uid, aQid)
+            if err == nil {
+               aDropQids = []string{aQid}
+               aEtc = tMsg{"dropnode": iHead.DropNode}
+            }
+            break
+         }
+         aNodeId := iHead.DropNode
+         aNodeKey := iHead.DropNode
+         if !isNodeRef(aNodeKey) {
+            aNodeKey, err = getNodeSecret(&iHead.DropNode)
+            if err != nil {
+               return sMsgBase32Bad
+            }
+         }
+         var aQid string
+         aQid, err = UDb.DropNode(o.uid, aNodeKey)
+         if err == nil {
+            aDropQids = []string{aQid}
+            aEtc = tMsg{"dropnode": aNodeId}
+         }
+      case iHead.DropUser != o.uid:
+         err = tError("dropuser must give sender's uid")
+      case iHead.Confirm == "":
+         aCode := make([]byte, 10)
+         _, err = rand.Read(aCode)
+         if err != nil { panic(err) }
+         o.confirm = sBase32.EncodeToString(aCode)
+         aAckEtc = tMsg{"confirm": o.confirm}
+      case iHead.Confirm != o.confirm:
+         o.confirm = ""
+         err = tError("dropuser confirm invalid")
+      default:
+         o.confirm = ""
+         aDropQids, err = UDb.DropUser(o.uid) // nodes now defunct, so no "user" msg
       }
-      if err == nil {
+      if err == nil && aEtc != nil {
          iHead.For = []tHeaderFor{{Id:o.uid, Type:eForUser}}
          _, _, err = o._postMsg(iHead, aEtc, nil)
       }
       if err != nil {
          fmt.Fprintf(os.Stderr, "%s link._handleMsg useredit %s\n", o._logNode(), err)
       }
-      o.queue.ackAsap(iHead.Id, "", "", err)
+      o.queue.ackAsap(iHead.Id, "", "", aAckEtc, err)
+      aQuit := sMsgNodeDropped; if iHead.DropUser != "" { aQuit = sMsgUserDropped }
+      if iHead.DropUser != "" && err == nil {
+         bounceQueued(o.uid, aDropQids)
+      }
+      for _, aQid := range aDropQids {
+         dropNode(aQid, aQuit) // may close this link
+      }
    case eOpOhiEdit:
       aStat := eOhiOff; if iHead.Type == "init" || iHead.Type == "add" { aStat = eOhiOn }
       if aStat != eOhiOn && iHead.Type != "drop" { return sMsgHeaderBad }
@@ -555,7 +1140,7 @@ func (o *tLink) _handleMsg(iHead *tHeader, iData []byte) *tMsgQuit {
             _, _, err = o._postMsg(aHead, aEtc, nil)
          }
       }
-      o.queue.ackAsap(iHead.Id, "", "", err)
+      o.queue.ackAsap(iHead.Id, "", "", nil, err)
    case eOpGroupInvite:
       iHead.Act = "invite"
       fallthrough
@@ -602,7 +1187,7 @@ func (o *tLink) _handleMsg(iHead *tHeader, iData []byte) *tMsgQuit {
       if err != nil {
          fmt.Fprintf(os.Stderr, "%s link._handleMsg group %s\n", o._logNode(), err)
       }
-      o.queue.ackAsap(iHead.Id, aMid, aPosted, err)
+      o.queue.ackAsap(iHead.Id, aMid, aPosted, nil, err)
    case eOpPost:
       aMid, aPosted, err = o._postMsg(iHead, nil, iData)
       if err != nil {
@@ -610,17 +1195,24 @@ func (o *tLink) _handleMsg(iHead *tHeader, iData []byte) *tMsgQuit {
          if aErr, _ := err.(net.Error); aErr != nil { return msgConn(aErr) }
          fmt.Fprintf(os.Stderr, "%s link._handleMsg post %s\n", o._logNode(), err)
       }
-      o.queue.ackAsap(iHead.Id, aMid, aPosted, err)
+      o.queue.ackAsap(iHead.Id, aMid, aPosted, nil, err)
    case eOpPostNotify:
       if iHead.DataLen <= iHead.NoteLen { return sMsgDatalenLow }
       if iHead.ForNotSelf && len(iHead.For) == 0 { return sMsgForEmpty }
-      aMid, aPosted, err = o._postNotify(iHead, iData)
+      err = o._checkFlag(iHead)
+      if err != nil {
+         aQuitMsg := o._skipData(iHead, iData)
+         if aQuitMsg != nil { return aQuitMsg }
+      } else {
+         aMid, aPosted, err = o._postNotify(iHead, iData)
+      }
+      sFlag.clear(o.uid, o.node)
       if err != nil {
          if err == io.EOF { return sMsgEof }
          if aErr, _ := err.(net.Error); aErr != nil { return msgConn(aErr) }
          fmt.Fprintf(os.Stderr, "%s link._handleMsg postNotify %s\n", o._logNode(), err)
       }
-      o.queue.ackAsap(iHead.Id, aMid, aPosted, err)
+      o.queue.ackAsap(iHead.Id, aMid, aPosted, nil, err)
    case eOpPing:
       aQuitMsg := o._checkPing(iHead, &iData)
       if aQuitMsg != nil { return aQuitMsg }
@@ -638,7 +1230,7 @@ func (o *tLink) _handleMsg(iHead *tHeader, iData []byte) *tMsgQuit {
       if err != nil {
          fmt.Fprintf(os.Stderr, "%s link._handleMsg ping %s\n", o._logNode(), err)
       }
-      o.queue.ackAsap(iHead.Id, aMid, aPosted, err)
+      o.queue.ackAsap(iHead.Id, aMid, aPosted, nil, err)
    case eOpAck:
       aTmr := time.NewTimer(2 * time.Second)
       select {
@@ -651,45 +1243,277 @@ func (o *tLink) _handleMsg(iHead *tHeader, iData []byte) *tMsgQuit {
       // no-op
    case eOpQuit:
       return sMsgLogout
+   case eOpListNodes:
+      var aNodes []map[string]interface{}
+      aNodes, err = UDb.GetNodes(o.uid)
+      aList := make([]tMsg, len(aNodes))
+      for a, aN := range aNodes {
+         aList[a] = tMsg{"num":aN["Num"], "label":aN["Label"]}
+         if fmt.Sprintf("%s.%02x", o.uid, aN["Num"]) == o.node {
+            aList[a]["self"] = true
+         }
+         if aT := aN["Created"].(int64); aT != 0 {
+            aList[a]["created"] = time.Unix(aT, 0).UTC().Format(kPostDateFormat)
+         }
+         if aT := aN["LastLogin"].(int64); aT != 0 {
+            aList[a]["lastlogin"] = time.Unix(aT, 0).UTC().Format(kPostDateFormat)
+            aList[a]["lastaddr"] = aN["LastAddr"]
+         }
+      }
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._handleMsg listnodes %s\n", o._logNode(), err)
+      }
+      o.queue.ackAsap(iHead.Id, "", "", tMsg{"nodes":aList}, err)
+   case eOpListLogins:
+      var aLogins []map[string]interface{}
+      aLogins, err = UDb.GetLogins(o.uid)
+      aList := make([]tMsg, len(aLogins))
+      for a, aL := range aLogins {
+         aList[a] = tMsg{"node":aL["Num"], "addr":aL["Addr"],
+                         "time":time.Unix(aL["Time"].(int64), 0).UTC().Format(kPostDateFormat)}
+      }
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._handleMsg listlogins %s\n", o._logNode(), err)
+      }
+      o.queue.ackAsap(iHead.Id, "", "", tMsg{"logins":aList}, err)
+   case eOpSetFlag:
+      if iHead.Type != "postnotify" { return sMsgHeaderBad }
+      aMark, err = sFlag.set(o.uid, o.node, iHead.Id)
+      if err != nil {
+         o.queue.ackAsap(iHead.Id, "", "", nil, err)
+      }
    default:
       panic(fmt.Sprintf("checkHeader failure, op %d", iHead.Op))
    }
    return nil
 }
 
-func (o *tLink) _checkPing(iHead *tHeader, iData *[]byte) *tMsgQuit {
-   const _kSizeMax = kPingCharMax * 3
-   if iHead.DataLen > _kSizeMax {
-      return sMsgDatalenHigh
+// verify recovery code or OIDC token; replace user's nodes with a new one, copying a queue
+func (o *tLink) _recover(iHead *tHeader) *tMsgQuit {
+   sRecoverDoor.Lock(); defer sRecoverDoor.Unlock() // recovery code is single use
+   var err error
+   if iHead.Oidc != nil && iHead.Oidc.Id_token == "" { // refresh token doesn't show user is present
+      return sMsgAuthRequired
    }
-   for len(*iData) < int(iHead.DataLen) {
-      aLen, err := o.Read((*iData)[len(*iData):iHead.DataLen]) // panics if cap() < DataLen
+   if iHead.Oidc != nil && iHead.Uid == "" { // find user via identity from Register
+      var aData tMsg
+      aData, err = validateTokenOpenid(iHead.Oidc, o.nonce)
       if err != nil {
-         if err == io.EOF {
-            return sMsgEof
-         } else if aErr, _ := err.(net.Error); aErr != nil {
-            return msgConn(aErr)
-         }
-         return &tMsgQuit{Op:"fail", Error:err.Error()}
+         fmt.Fprintf(os.Stderr, "%s link._recover %s\n", o._logNode(), err)
+         return sMsgAuthRequired
       }
-      *iData = (*iData)[:len(*iData)+aLen]
-   }
-   var aUtf16Len int64
-   for a, aStep := 0, 0; a < len(*iData); a += aStep {
-      var aR rune
-      aR, aStep = utf8.DecodeRune((*iData)[a:])
-      if aR == utf8.RuneError {
-         return sMsgDataNotUtf8
+      var aUids []string
+      aUids, err = UDb.LookupAuth(aData["Issuer"].(string), aData["Subject"].(string))
+      if err == nil && len(aUids) != 1 {
+         err = tError(fmt.Sprintf("%d users for identity", len(aUids))) // client must give uid
       }
-      if aR >= 0x10000 {
-         aUtf16Len++
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._recover %s\n", o._logNode(), err)
+         return sMsgRecoverFailure
       }
-      aUtf16Len++
-   }
-   if aUtf16Len > kPingCharMax {
-      return sMsgDatalenHigh
-   }
-   return nil
+      iHead.Uid = aUids[0]
+   } else if iHead.Oidc != nil {
+      _, aQuit := o._checkAuth(iHead.Uid, iHead.Oidc)
+      if aQuit != nil { return aQuit }
+   } else {
+      var aRecovery string
+      aRecovery, err = getNodeSecret(&iHead.Recovery)
+      if err != nil {
+         return sMsgBase32Bad
+      }
+      err = UDb.VerifyRecovery(iHead.Uid, aRecovery)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._recover %s\n", o._logNode(), err)
+         return sMsgRecoverFailure
+      }
+   }
+   aNodeId, aNodeKey, aPake, aErr := makeNode(iHead.PakeSalt, iHead.PakeVerifier)
+   if aErr != nil {
+      return sMsgPakeBad
+   }
+   var aOldQids []string
+   aOldQids, err = UDb.OpenNodes(iHead.Uid)
+   if err != nil {
+      return sMsgRecoverFailure
+   }
+   _ = UDb.CloseNodes(iHead.Uid)
+   var aQid string
+   aQid, err = UDb.AddNode(iHead.Uid, aNodeKey, iHead.NewNode, aPake)
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "%s link._recover %s\n", o._logNode(), err)
+      return sMsgRecoverFailure
+   }
+   for _, aOld := range aOldQids { // merge queues; a msg queued on several nodes is linked once
+      err = sStore.copyDir(aOld, aQid)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._recover %s\n", o._logNode(), err)
+         if aErr := UDb.DropQid(iHead.Uid, aQid); aErr == nil {
+            _ = sStore.rmDir(aQid)
+         }
+         return sMsgRecoverFailure
+      }
+   }
+   aDefunct := make([]uint64, len(aOldQids))
+   for a := range aOldQids {
+      aDefunct[a], _ = strconv.ParseUint(aOldQids[a][strings.LastIndexByte(aOldQids[a], '.')+1:], 16, 8)
+   }
+   sort.Slice(aDefunct, func(cA, cB int) bool { return aDefunct[cA] < aDefunct[cB] })
+   err = postFromServer(iHead.Uid, 'E', tMsg{"op":"user", "from":iHead.Uid, "recovered":iHead.NewNode,
+                                             "defunctnodes":aDefunct})
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "%s link._recover %s\n", o._logNode(), err)
+   }
+   for _, aOld := range aOldQids {
+      err = UDb.DropQid(iHead.Uid, aOld)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._recover %s\n", o._logNode(), err)
+         continue
+      }
+      dropNode(aOld, sMsgNodeDropped)
+   }
+   aAck := tMsg{"op":sMsgOps[iHead.Op], "uid":iHead.Uid, "nodeid":aNodeId}
+   aCode, aRecovery := makeRecovery()
+   err = UDb.SetRecovery(iHead.Uid, aRecovery)
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "%s link._recover %s\n", o._logNode(), err)
+   } else {
+      aAck["recovery"] = aCode
+   }
+   o.conn.Write(packMsg(aAck, nil))
+   fmt.Printf("%s - recover %s\n", _logNode(aQid), o.conn.RemoteAddr().String())
+   return nil
+}
+
+// redeem pairing code from a logged-in node; add a node for its user, copying that node's queue
+func (o *tLink) _pair(iHead *tHeader) *tMsgQuit {
+   aCode, err := sBase32.DecodeString(iHead.PairCode)
+   if err != nil {
+      return sMsgBase32Bad
+   }
+   aNodeId, aNodeKey, aPake, aErr := makeNode(iHead.PakeSalt, iHead.PakeVerifier)
+   if aErr != nil {
+      return sMsgPakeBad
+   }
+   aAddr, _, _ := net.SplitHostPort(o.conn.RemoteAddr().String())
+   aPair, err := usePair(iHead.Uid, aCode, aAddr)
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "%s link._pair %s\n", o._logNode(), err)
+      return sMsgPairFailure
+   }
+   aQid, err := UDb.AddNode(aPair.uid, aNodeKey, aPair.label, aPake)
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "%s link._pair %s\n", o._logNode(), err)
+      return sMsgPairFailure
+   }
+   err = sStore.copyDir(aPair.node, aQid)
+   if err != nil { panic(err) }
+   err = postFromServer(aPair.uid, 'E', tMsg{"op":"user", "from":aPair.uid, "newnode":aPair.label})
+   if err != nil { panic(err) }
+   o.conn.Write(packMsg(tMsg{"op":sMsgOps[iHead.Op], "uid":aPair.uid, "nodeid":aNodeId}, nil))
+   fmt.Printf("%s - pair %s\n", _logNode(aQid), o.conn.RemoteAddr().String())
+   return nil
+}
+
+// check OIDC token against identity stored at registration; given only a refresh token,
+// obtain id_token from provider, and return its new refresh token, if any
+func (o *tLink) _checkAuth(iUid string, iTok *tOpenidToken) (string, *tMsgQuit) {
+   if iTok == nil {
+      return "", sMsgAuthRequired
+   }
+   aAuth, err := UDb.GetAuth(iUid)
+   if err != nil {
+      return "", sMsgLoginFailure
+   }
+   aIss, _ := aAuth["Issuer"].(string)
+   if aIss == "" {
+      return "", sMsgAuthMismatch
+   }
+   aNonce, aRefresh := o.nonce, ""
+   if iTok.Id_token == "" && iTok.Refresh_token != "" {
+      iTok, err = refreshTokenOpenid(aIss, iTok.Refresh_token)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._checkAuth %s\n", o._logNode(), err)
+         return "", sMsgAuthRequired
+      }
+      aNonce, aRefresh = "", iTok.Refresh_token
+   }
+   aData, err := validateTokenOpenid(iTok, aNonce)
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "%s link._checkAuth %s\n", o._logNode(), err)
+      return "", sMsgAuthRequired
+   }
+   if aData["Subject"] != aAuth["Subject"] || aData["Issuer"] != aIss {
+      return "", sMsgAuthMismatch
+   }
+   return aRefresh, nil
+}
+
+func (o *tLink) _checkPing(iHead *tHeader, iData *[]byte) *tMsgQuit {
+   const _kSizeMax = kPingCharMax * 3
+   if iHead.DataLen > _kSizeMax {
+      return sMsgDatalenHigh
+   }
+   for len(*iData) < int(iHead.DataLen) {
+      aLen, err := o.Read((*iData)[len(*iData):iHead.DataLen]) // panics if cap() < DataLen
+      if err != nil {
+         if err == io.EOF {
+            return sMsgEof
+         } else if aErr, _ := err.(net.Error); aErr != nil {
+            return msgConn(aErr)
+         }
+         return &tMsgQuit{Op:"fail", Error:err.Error()}
+      }
+      *iData = (*iData)[:len(*iData)+aLen]
+   }
+   var aUtf16Len int64
+   for a, aStep := 0, 0; a < len(*iData); a += aStep {
+      var aR rune
+      aR, aStep = utf8.DecodeRune((*iData)[a:])
+      if aR == utf8.RuneError {
+         return sMsgDataNotUtf8
+      }
+      if aR >= 0x10000 {
+         aUtf16Len++
+      }
+      aUtf16Len++
+   }
+   if aUtf16Len > kPingCharMax {
+      return sMsgDatalenHigh
+   }
+   return nil
+}
+
+func (o *tLink) _skipData(iHead *tHeader, iData []byte) *tMsgQuit {
+   _, err := io.CopyN(ioutil.Discard, o, iHead.DataLen - int64(len(iData)))
+   if err != nil {
+      if err == io.EOF {
+         return sMsgEof
+      } else if aErr, _ := err.(net.Error); aErr != nil {
+         return msgConn(aErr)
+      }
+      return &tMsgQuit{Op:"fail", Error:err.Error()}
+   }
+   return nil
+}
+
+func (o *tLink) _checkFlag(iHead *tHeader) error {
+   if !sFlag.isSet(o.uid, o.node) {
+      return tError("postnotify flag not set")
+   }
+   for _, aTo := range iHead.NoteFor {
+      aUids := []string{aTo.Id}
+      if aTo.Type == eForGroupAll || aTo.Type == eForGroupExcl {
+         var err error
+         aUids, err = UDb.GroupGetUsers(aTo.Id, o.uid)
+         if err != nil { return err }
+      }
+      for _, aUid := range aUids {
+         if aUid != o.uid && sFlag.isSet(aUid, "") {
+            return tError("postnotify flag set by notefor member; retry later")
+         }
+      }
+   }
+   return nil
 }
 
 func (o *tLink) _sendOhi(iNodes []string, iStat int8) {
@@ -724,32 +1548,47 @@ func (o *tLink) _postNotify(iHead *tHeader, iData []byte) (aMsgId, aPosted strin
    aHead["headsum"] = crc32.Checksum(packMsg(aHead, nil), sCrc32c)
 
    aData := iData; if len(iData) > int(iHead.NoteLen) { aData = iData[:iHead.NoteLen] }
-   err = sStore.recvFile(aNoteId, packMsg(aHead, nil), aData, o, iHead.NoteLen)
+   err = sStore.recvFile(aNoteId, packMsg(aHead, nil), aData, o, iHead.NoteLen, iHead.NoteSum)
    if err != nil {
-      if _, ok := err.(net.Error); !ok && err != io.EOF { panic(err) }
+      if _, ok := err.(net.Error); !ok && err != io.EOF && err != sErrDataSum { panic(err) }
    }
    defer sStore.rmFile(aNoteId)
+   if err == sErrDataSum { // skip remaining data
+      aLen := iHead.DataLen - iHead.NoteLen
+      if len(iData) > int(iHead.NoteLen) { aLen -= int64(len(iData)) - iHead.NoteLen }
+      _, err = io.CopyN(ioutil.Discard, o, aLen)
+      if err == nil { err = tError("notesum does not match note") }
+   }
    if err != nil { return "", "", err }
 
    aData = nil; if len(iData) > int(iHead.NoteLen) { aData = iData[iHead.NoteLen:] }
    aNotify := len(iHead.For)+len(iHead.NoteFor); if !iHead.ForNotSelf { aNotify++ }
    iHead.DataLen -= iHead.NoteLen
-   _, _, err = o._postMsgId(iHead, nil, aData, aMsgId, aNotify)
+   var aOver, aOverNote []string
+   _, _, aOver, err = o._postMsgId(iHead, nil, aData, aMsgId, aNotify)
    iHead.DataLen += iHead.NoteLen
    if err != nil { return "", "", err }
 
-   err = o._queueMsg(aNoteId, kPrioDefault, iHead.NoteFor, iHead.For, true) // modifies .NoteFor
+   aOverNote, err = o._queueMsg(aNoteId, kPrioDefault, iHead.NoteFor, iHead.For, true) // modifies .NoteFor
    if err != nil { return "", "", err }
+   for _, aUid := range aOverNote {
+      aN := 0; for aN < len(aOver) && aOver[aN] != aUid { aN++ }
+      if aN == len(aOver) { aOver = append(aOver, aUid) }
+   }
+   o._bounceQuota(aOver, aMsgId, aPosted)
 
    return aMsgId, aPosted, nil
 }
 
 func (o *tLink) _postMsg(iHead *tHeader, iEtc tMsg, iData []byte) (string, string, error) {
-   return o._postMsgId(iHead, iEtc, iData, sStore.makeId(), 0)
+   aId, aPosted, aOver, err := o._postMsgId(iHead, iEtc, iData, sStore.makeId(), 0)
+   o._bounceQuota(aOver, aId, aPosted)
+   return aId, aPosted, err
 }
 
+// return also recipients skipped for lack of quota
 func (o *tLink) _postMsgId(iHead *tHeader, iEtc tMsg, iData []byte, iId string, iNotify int) (
-                                                            _, aPosted string, err error) {
+                                                      _, aPosted string, aOver []string, err error) {
    aPosted = time.Now().UTC().Format(kPostDateFormat)
    aHead := tMsg{"op":sMsgOps[iHead.Op], "id":iId, "from":o.uid, "datalen":iHead.DataLen,
                  "posted":aPosted}
@@ -768,36 +1607,49 @@ func (o *tLink) _postMsgId(iHead *tHeader, iEtc tMsg, iData []byte, iId string,
    }
    aHead["headsum"] = crc32.Checksum(packMsg(aHead, nil), sCrc32c)
 
-   err = sStore.recvFile(iId, packMsg(aHead, nil), iData, o, iHead.DataLen)
+   err = sStore.recvFile(iId, packMsg(aHead, nil), iData, o, iHead.DataLen, iHead.DataSum)
    if err != nil {
-      if _, ok := err.(net.Error); !ok && err != io.EOF { panic(err) }
+      if _, ok := err.(net.Error); !ok && err != io.EOF && err != sErrDataSum { panic(err) }
    }
    defer sStore.rmFile(iId)
-   if err != nil { return "", "", err }
+   if err != nil { return "", "", nil, err }
 
    aPrio := kPrioDefault; if sMsgOps[iHead.Op] == "user" { aPrio = 'E' }
-   err = o._queueMsg(iId, aPrio, iHead.For, nil, iHead.Op != eOpPostNotify || !iHead.ForNotSelf)
+   aOver, err = o._queueMsg(iId, aPrio, iHead.For, nil, iHead.Op != eOpPostNotify || !iHead.ForNotSelf)
          // may change .For
-   if err != nil { return "", "", err }
+   if err != nil { return "", "", nil, err }
 
-   return iId, aPosted, nil
+   return iId, aPosted, aOver, nil
 }
 
-func (o *tLink) _queueMsg(iMsgId string, iPrio byte, iForA, iForB []tHeaderFor, iSelf bool) error {
-   var err error
+// return recipients skipped for lack of quota; fail if no other recipient remains
+func (o *tLink) _queueMsg(iMsgId string, iPrio byte, iForA, iForB []tHeaderFor, iSelf bool) (
+                                                                  aOver []string, err error) {
    if iSelf {
       iForA = append(iForA, tHeaderFor{Id:o.uid, Type:eForSelf})
    }
    iForA = append(iForA, iForB...)
    aForNodes := make(map[string]bool, len(iForA)) //todo x2 or more?
    aForMyUid := false
+   aQuotaUids := make(map[string][]string) // recipients subject to quota
+   var aDropped map[string][]tMsg // heads of msgs dropped for quota, by recipient
+   defer func() { // after CloseNodes, as postFromServer opens the sender's nodes
+      for aUid, aHeads := range aDropped {
+         for _, aHead := range aHeads {
+            err := bounceMsg(aUid, aHead, "recipient queue exceeds quota")
+            if err != nil {
+               fmt.Fprintf(os.Stderr, "%s link._queueMsg %s\n", o._logNode(), err)
+            }
+         }
+      }
+   }()
 
    for _, aTo := range iForA {
       var aUids []string
       switch aTo.Type {
       case eForGroupAll, eForGroupExcl:
          aUids, err = UDb.GroupGetUsers(aTo.Id, o.uid)
-         if err != nil { return err }
+         if err != nil { return nil, err }
       default:
          aUids = []string{aTo.Id}
       }
@@ -807,12 +1659,29 @@ func (o *tLink) _queueMsg(iMsgId string, iPrio byte, iForA, iForB []tHeaderFor,
          }
          var aNodes []string
          aNodes, err = UDb.OpenNodes(aUid)
-         if err != nil { return err }
+         if err != nil { return nil, err }
          defer UDb.CloseNodes(aUid)
          for _, aNd := range aNodes {
             aForNodes[aNd] = true
          }
          aForMyUid = aForMyUid || aUid == o.uid && aTo.Type != eForSelf
+         if sLimits.Quota > 0 && iPrio == kPrioDefault && aUid != o.uid {
+            aQuotaUids[aUid] = aNodes
+         }
+      }
+   }
+   if len(aQuotaUids) > 0 {
+      var aRoom map[string]int64
+      aRoom, aOver, aDropped, err = o._checkQuota(iMsgId, aQuotaUids)
+      if err != nil { return nil, err }
+      defer func() { // after putLink counts the usage
+         for aUid, aLen := range aRoom { sStore.unreserve(aUid, aLen) }
+      }()
+      if len(aRoom) == 0 { // msg is for no one else
+         return nil, tError("recipient queue exceeds quota")
+      }
+      for _, aUid := range aOver {
+         for _, aNd := range aQuotaUids[aUid] { delete(aForNodes, aNd) }
       }
    }
    aPrioId := string(iPrio) + iMsgId
@@ -825,13 +1694,56 @@ func (o *tLink) _queueMsg(iMsgId string, iPrio byte, iForA, iForB []tHeaderFor,
       err = sStore.putLink(iMsgId, aNodeId, aPrioId)
       if err != nil { panic(err) }
       if aNd.queue != nil {
-         aNd.queue.in <- aPrioId
+         aNd.queue.put(aPrioId)
       }
       aNd.RUnlock()
    }
-   return nil
+   return aOver, nil
 }
 
+// reserve room for msg in queues of iUids, dropping old msgs if so configured;
+// return octets reserved per uid, uids without room, and heads of dropped msgs per uid
+func (o *tLink) _checkQuota(iMsgId string, iUids map[string][]string) (
+                  aRoom map[string]int64, aOver []string, aDropped map[string][]tMsg, err error) {
+   aLen, err := sStore.tempSize(iMsgId)
+   if err != nil { return nil, nil, nil, err }
+   aRoom = make(map[string]int64, len(iUids))
+   for aUid, aNodes := range iUids {
+      aNeed := aLen * int64(len(aNodes))
+      if sStore.reserve(aUid, aNeed, sLimits.Quota) {
+         aRoom[aUid] = aNeed
+         continue
+      }
+      if sLimits.QuotaPolicy == "dropold" && aNeed <= sLimits.Quota {
+         var aHeads []tMsg
+         aHeads, err = sStore.dropOld(aUid, aNodes, aNeed, sLimits.Quota) // reserves aNeed
+         if len(aHeads) > 0 {
+            if aDropped == nil { aDropped = make(map[string][]tMsg) }
+            aDropped[aUid] = aHeads
+         }
+         if err == nil {
+            aRoom[aUid] = aNeed
+            continue
+         }
+         if _, ok := err.(tError); !ok {
+            fmt.Fprintf(os.Stderr, "%s link._checkQuota %s\n", o._logNode(), err)
+         }
+      }
+      aOver = append(aOver, aUid)
+   }
+   return aRoom, aOver, aDropped, nil
+}
+
+// notify sender's nodes that msg was not queued for iUids
+func (o *tLink) _bounceQuota(iUids []string, iMsgId, iPosted string) {
+   for _, aUid := range iUids {
+      err := postFromServer(o.uid, kPrioDefault, tMsg{"op":"bounce", "from":aUid, "msgid":iMsgId,
+                                                     "msgposted":iPosted, "error":"recipient queue exceeds quota"})
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._bounceQuota %s\n", o._logNode(), err)
+      }
+   }
+}
 
 type tOhi struct {
    from tOhiMap // users notifying others of presence
@@ -918,6 +1830,55 @@ func (o *tOhi) getOhiTo(iUid string) []string {
 }
 
 
+type tFlags struct {
+   list tFlagMap
+   sync.Mutex
+}
+
+type tFlagMap map[string]*tFlag // indexed by uid
+
+type tFlag struct {
+   node string // set by this node
+   id string // SetFlag request id, for ack
+   mark string // queue item that triggers ack
+}
+
+func (o *tFlags) set(iUid, iNode, iId string) (string, error) {
+   o.Lock(); defer o.Unlock()
+   if o.list[iUid] != nil {
+      return "", tError("postnotify flag already set")
+   }
+   aMark := string(kPrioDefault) + sStore.makeId() + "." + iUid // sorts after queued msgs
+   o.list[iUid] = &tFlag{node:iNode, id:iId, mark:aMark}
+   return aMark, nil
+}
+
+func (o *tFlags) clear(iUid, iNode string) {
+   o.Lock()
+   if aFlag := o.list[iUid]; aFlag != nil && aFlag.node == iNode {
+      delete(o.list, iUid)
+   }
+   o.Unlock()
+}
+
+func (o *tFlags) isSet(iUid, iNode string) bool {
+   o.Lock(); defer o.Unlock()
+   aFlag := o.list[iUid]
+   return aFlag != nil && (iNode == "" || aFlag.node == iNode)
+}
+
+func (o *tFlags) markId(iMark string) string {
+   o.Lock(); defer o.Unlock()
+   aFlag := o.list[iMark[strings.IndexByte(iMark, '.')+1:]]
+   if aFlag == nil || aFlag.mark != iMark {
+      return "" // flag cleared
+   }
+   return aFlag.id
+}
+
+func isFlagMark(iMid string) bool { return strings.IndexByte(iMid, '.') >= 0 }
+
+
 type tNodes struct {
    list tNodeMap // nodes that have received msgs or loggedin
    sync.RWMutex //todo Mutex when sync.map
@@ -948,6 +1909,200 @@ func getNode(iNode string) *tNode {
    return aNd
 }
 
+func dropNode(iNode string, iQuit *tMsgQuit) {
+   aNd := getNode(iNode)
+   aNd.Lock()
+   aQ := aNd.queue
+   aNd.queue = nil
+   err := sStore.rmDir(iNode)
+   if err != nil { panic(err) }
+   dropResume(iNode)
+   dropPair(iNode)
+   aNd.Unlock()
+   if aQ != nil { // may wait for link, so not under lock
+      aQ.closeLink(iQuit)
+      close(aQ.done)
+   }
+   fmt.Printf("%s - drop node\n", _logNode(iNode))
+}
+
+func _runSweeper() {
+   aReminded := make(map[string]time.Time) // indexed by node id
+   aQuietMin := _days(sLimits.NodeRemind); if aQuietMin == 0 { aQuietMin = _days(sLimits.NodeExpire) }
+   for {
+      time.Sleep(kSweepInterval)
+      aNow := time.Now()
+      aQuiet, err := getQuiet(aNow.Add(-aQuietMin))
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "sweeper %s\n", err)
+         continue
+      }
+      sweepNodes(aNow, aQuiet, aReminded)
+   }
+}
+
+// return nodes without login since iBefore, with time of last login or creation
+func getQuiet(iBefore time.Time) (map[string]time.Time, error) {
+   aLogins, err := UDb.GetQuiet(iBefore.Unix())
+   if err != nil { return nil, err }
+   aQueued, err := sStore.getQuiet(iBefore) // for nodes made before login times were recorded
+   if err != nil { return nil, err }
+   aQuiet := make(map[string]time.Time, len(aLogins))
+   for aQid, aTime := range aLogins {
+      if aTime != 0 {
+         aQuiet[aQid] = time.Unix(aTime, 0)
+      } else if aSince, ok := aQueued[aQid]; ok {
+         aQuiet[aQid] = aSince
+      }
+   }
+   return aQuiet, nil
+}
+
+// remind user's nodes of quiet nodes, or expire them; iReminded is indexed by node id
+func sweepNodes(iNow time.Time, iQuiet, iReminded map[string]time.Time) {
+   aRemind, aExpire := _days(sLimits.NodeRemind), _days(sLimits.NodeExpire)
+   for aQid := range iReminded {
+      if _, ok := iQuiet[aQid]; !ok { delete(iReminded, aQid) }
+   }
+   for aQid, aSince := range iQuiet {
+      if isOnline(aQid) {
+         continue
+      }
+      var err error
+      aDot := strings.LastIndexByte(aQid, '.')
+      aUid := aQid[:aDot]
+      aNodeNum, _ := strconv.ParseUint(aQid[aDot+1:], 16, 8)
+      aExpired := aExpire != 0 && iNow.Sub(aSince) >= aExpire
+      if aExpired {
+         var aNodes []string
+         aNodes, err = UDb.OpenNodes(aUid)
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "%s sweeper %s\n", _logNode(aQid), err)
+            continue
+         }
+         _ = UDb.CloseNodes(aUid)
+         aExpired = len(aNodes) > 1 // user's last node is kept for their return, and reminded
+      }
+      if aExpired {
+         err = UDb.DropQid(aUid, aQid)
+         if err == nil {
+            err = postFromServer(aUid, 'E', tMsg{"op":"user", "from":aUid, "defunctnode":aNodeNum})
+            dropNode(aQid, sMsgNodeDropped)
+            delete(iReminded, aQid)
+         }
+      } else if aRemind != 0 && iNow.Sub(iReminded[aQid]) >= aRemind {
+         err = postFromServer(aUid, 'E', tMsg{"op":"user", "from":aUid, "quietnode":aNodeNum,
+                                              "quietsince":aSince.UTC().Format(kPostDateFormat)})
+         iReminded[aQid] = iNow
+      }
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s sweeper %s\n", _logNode(aQid), err)
+      }
+   }
+}
+
+// return msgs from other users queued for iNodes, which are defunct or expired, to their senders;
+// remove them from the queues
+func bounceQueued(iUid string, iNodes []string) {
+   aDone := make(map[string]bool) // msgids already bounced
+   for _, aNode := range iNodes {
+      aDir, err := sStore.getDir(aNode)
+      if err != nil { panic(err) }
+      for _, aId := range aDir {
+         if aId[0] != kPrioDefault {
+            continue
+         }
+         var aHead tMsg
+         aHead, err = sStore.getHead(aNode, aId)
+         if err != nil {
+            if !os.IsNotExist(err) { // else delivered meanwhile
+               fmt.Fprintf(os.Stderr, "%s bounceQueued %s\n", _logNode(aNode), err)
+            }
+            continue
+         }
+         if !isFromOther(iUid, aHead) {
+            continue
+         }
+         aMsgId := bounceId(aHead)
+         if !aDone[aMsgId] {
+            aDone[aMsgId] = true
+            err = bounceMsg(iUid, aHead, "")
+            if err != nil {
+               fmt.Fprintf(os.Stderr, "%s bounceQueued %s\n", _logNode(aNode), err)
+               continue // retry later
+            }
+         }
+         err = sStore.rmLink(aNode, aId)
+         if err != nil && !os.IsNotExist(err) {
+            fmt.Fprintf(os.Stderr, "%s bounceQueued %s\n", _logNode(aNode), err)
+         }
+      }
+   }
+}
+
+// whether queued msg iHead was posted by a user other than recipient iUid
+func isFromOther(iUid string, iHead tMsg) bool {
+   aFrom, _ := iHead["from"].(string)
+   return aFrom != "" && aFrom != iUid
+}
+
+// id of msg iHead known to its sender
+func bounceId(iHead tMsg) string {
+   if aPostId, _ := iHead["postid"].(string); aPostId != "" { // notify of postnotify
+      return aPostId
+   }
+   aMsgId, _ := iHead["id"].(string)
+   return aMsgId
+}
+
+// notify sender of queued msg iHead that it was not delivered to iUid
+func bounceMsg(iUid string, iHead tMsg, iErr string) error {
+   aMsg := tMsg{"op":"bounce", "from":iUid, "msgid":bounceId(iHead), "msgposted":iHead["posted"]}
+   if iErr != "" {
+      aMsg["error"] = iErr
+   }
+   return postFromServer(iHead["from"].(string), kPrioDefault, aMsg)
+}
+
+func _days(i int) time.Duration { return time.Duration(i) * 24 * time.Hour }
+
+func isOnline(iNode string) bool {
+   sNode.RLock()
+   aNd := sNode.list[iNode]
+   sNode.RUnlock()
+   if aNd == nil {
+      return false
+   }
+   aNd.RLock(); defer aNd.RUnlock()
+   return aNd.queue != nil && atomic.LoadInt32(&aNd.queue.hasConn) == 1
+}
+
+// queue a msg composed by the server to a user's nodes; iHead gives op, from, etc
+func postFromServer(iUid string, iPrio byte, iHead tMsg) error {
+   aNodes, err := UDb.OpenNodes(iUid)
+   if err != nil { return err }
+   defer UDb.CloseNodes(iUid)
+   aId := sStore.makeId()
+   aHead := tMsg{"id":aId, "datalen":0, "posted":time.Now().UTC().Format(kPostDateFormat)}
+   for aK, aV := range iHead { aHead[aK] = aV }
+   aHead["headsum"] = crc32.Checksum(packMsg(aHead, nil), sCrc32c)
+
+   err = sStore.recvFile(aId, packMsg(aHead, nil), nil, nil, 0, 0)
+   if err != nil { panic(err) }
+   defer sStore.rmFile(aId)
+   aPrioId := string(iPrio) + aId
+   for _, aNodeId := range aNodes {
+      aNd := getNode(aNodeId)
+      aNd.RLock()
+      err = sStore.putLink(aId, aNodeId, aPrioId)
+      if err != nil { panic(err) }
+      if aNd.queue != nil {
+         aNd.queue.put(aPrioId)
+      }
+      aNd.RUnlock()
+   }
+   return nil
+}
 
 type tQueue struct {
    node string
@@ -959,9 +2114,15 @@ type tQueue struct {
    out chan string // elastic channel output
    ohi chan tOhiMsg // presence notifications to us
    off chan struct{} // connection offline
+   held int32 // atomic; deliveries await reauthentication
+   unheld chan struct{} // signals held cleared
+   ohiDoor sync.Mutex
+   ohiHeld map[string]int8 // latest status by uid, received while held
+   done chan struct{} // closed when node is dropped; queue goroutines exit
 }
 
-func queueLink(iNode string, iConn net.Conn, iMsg tMsg, iUid string) *tQueue {
+// iHold withholds deliveries until the link reauthenticates
+func queueLink(iNode string, iConn net.Conn, iMsg tMsg, iUid string, iHold bool) *tQueue {
    var err error
    aNd := getNode(iNode)
    if aNd.queue == nil {
@@ -979,6 +2140,8 @@ func queueLink(iNode string, iConn net.Conn, iMsg tMsg, iUid string) *tQueue {
          aQ.out = make(chan string)
          aQ.ohi = make(chan tOhiMsg, 100) //todo tune size
          aQ.off = make(chan struct{})
+         aQ.unheld = make(chan struct{}, 1)
+         aQ.done = make(chan struct{})
          aQ.buf, err = sStore.getDir(iNode)
          if err != nil { panic(err) }
          aNd.Unlock()
@@ -1000,12 +2163,34 @@ func queueLink(iNode string, iConn net.Conn, iMsg tMsg, iUid string) *tQueue {
    if err != nil {
       fmt.Fprintf(os.Stderr, "%s queueLink msg %s\n", aNd.queue._logNode(), err)
    }
+   aNd.queue.ohiDoor.Lock()
+   aNd.queue.ohiHeld = nil // msg gave current ohi
+   aNd.queue.ohiDoor.Unlock()
+   aNd.queue.hold(iHold) // before conn is available
    aNd.queue.connChan <- iConn
    return aNd.queue
 }
 
 func (o *tQueue) _logNode() string { return _logNode(o.node) }
 
+func (o *tQueue) put(iId string) {
+   select {
+   case o.in <- iId:
+   case <-o.done: // node dropped
+   }
+}
+
+func (o *tQueue) hold(iOn bool) {
+   if iOn {
+      atomic.StoreInt32(&o.held, 1)
+   } else if atomic.SwapInt32(&o.held, 0) != 0 {
+      select {
+      case o.unheld <- struct{}{}:
+      default:
+      }
+   }
+}
+
 func (o *tQueue) unlink() {
    <-o.connChan
    select {
@@ -1015,16 +2200,35 @@ func (o *tQueue) unlink() {
    atomic.StoreInt32(&o.hasConn, 0)
 }
 
-func (o *tQueue) ackAsap(iId, iMsgId, iPosted string, iErr error) {
-   aMsg := struct { //todo reorder when tTestWork.want changes to map[string]interface{}
-      Error  string `json:"error,omitempty"`
-      Id     string `json:"id"`
-      MsgId  string `json:"msgid,omitempty"`
-      Op     string `json:"op"`
-      Posted string `json:"posted,omitempty"`
-   }{Op: "ack", Id: iId, MsgId: iMsgId, Posted: iPosted}
+func (o *tQueue) closeLink(iQuit *tMsgQuit) {
+   if atomic.LoadInt32(&o.hasConn) == 0 {
+      return
+   }
+   aTmr := time.NewTimer(2 * time.Second)
+   select {
+   case aConn := <-o.connChan:
+      aTmr.Stop()
+      if iQuit != nil {
+         _, err := aConn.Write(packMsg(iQuit, nil))
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "%s queue.closeLink %s\n", o._logNode(), err)
+         }
+      }
+      aConn.Close() // link's reader gets an error and calls unlink()
+      o.connChan <- aConn
+   case <-aTmr.C:
+      fmt.Fprintf(os.Stderr, "%s queue.closeLink timed out\n", o._logNode())
+   }
+}
+
+func (o *tQueue) ackAsap(iId, iMsgId, iPosted string, iEtc tMsg, iErr error) {
+   aMsg := tMsg{"op":"ack", "id":iId}
+   if iMsgId != "" {
+      aMsg["msgid"], aMsg["posted"] = iMsgId, iPosted
+   }
+   for aK, aV := range iEtc { aMsg[aK] = aV }
    if iErr != nil {
-      aMsg.Error = iErr.Error()
+      aMsg["error"] = iErr.Error()
    }
    aConn := <-o.connChan
    _, err := aConn.Write(packMsg(aMsg, nil))
@@ -1034,44 +2238,146 @@ func (o *tQueue) ackAsap(iId, iMsgId, iPosted string, iErr error) {
    }
 }
 
+// return "" if node dropped
 func (o *tQueue) _waitForMsg() string {
    for {
       select {
+      case <-o.done:
+         return ""
       case aMid := <-o.out:
-         return aMid
+         if !isFlagMark(aMid) {
+            return aMid
+         }
+         o._ackFlag(aMid)
       case aOhi := <-o.ohi:
          o._tryOhi(&aOhi)
+      case <-o.unheld:
+         o._tryOhi(nil)
       }
    }
 }
 
+func (o *tQueue) _ackFlag(iMark string) {
+   if sFlag.markId(iMark) == "" {
+      return
+   }
+   aConn := o._waitForConn()
+   if aConn == nil {
+      return
+   }
+   if aId := sFlag.markId(iMark); aId != "" { // link may have dropped
+      _, err := aConn.Write(packMsg(tMsg{"op":"ack", "id":aId}, nil))
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s queue._ackFlag %s\n", o._logNode(), err)
+      }
+   }
+   o.connChan <- aConn
+}
+
+// return nil if node dropped
+func (o *tQueue) _waitForConn() net.Conn {
+   for {
+      select {
+      case <-o.done:
+         return nil
+      case aOhi := <-o.ohi:
+         o._tryOhi(&aOhi)
+      case aConn := <-o.connChan:
+         return aConn
+      }
+   }
+}
+
+// wait for conn while deliveries are not held
+func (o *tQueue) _waitForDelivery() net.Conn {
+   for {
+      aConn := o._waitForConn()
+      if aConn == nil || atomic.LoadInt32(&o.held) == 0 {
+         if aConn != nil { o._sendOhiHeld(aConn) }
+         return aConn
+      }
+      o.connChan <- aConn
+      select {
+      case <-o.done:
+      case <-o.unheld:
+      case aOhi := <-o.ohi:
+         o._tryOhi(&aOhi)
+      }
+   }
+}
+
+// iOhi may be nil, to send msgs received while held
 func (o *tQueue) _tryOhi(iOhi *tOhiMsg) {
+   o.ohiDoor.Lock()
+   if atomic.LoadInt32(&o.held) != 0 {
+      if iOhi != nil {
+         if o.ohiHeld == nil { o.ohiHeld = map[string]int8{} }
+         o.ohiHeld[iOhi.from] = iOhi.status
+      }
+      o.ohiDoor.Unlock()
+      return
+   }
+   o.ohiDoor.Unlock()
    select {
    case aConn := <-o.connChan:
-      aMsg := tMsg{"op":"ohi", "from":iOhi.from, "status":iOhi.status}
-      _, err := aConn.Write(packMsg(aMsg, nil))
+      o._sendOhiHeld(aConn)
+      if iOhi != nil {
+         aMsg := tMsg{"op":"ohi", "from":iOhi.from, "status":iOhi.status}
+         _, err := aConn.Write(packMsg(aMsg, nil))
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "%s queue._tryOhi write error %s\n", o._logNode(), err)
+         }
+      }
       o.connChan <- aConn
+   default: // drop msg
+   }
+}
+
+// caller holds conn
+func (o *tQueue) _sendOhiHeld(iConn net.Conn) {
+   o.ohiDoor.Lock()
+   aHeld := o.ohiHeld
+   o.ohiHeld = nil
+   o.ohiDoor.Unlock()
+   for aFrom, aStat := range aHeld {
+      _, err := iConn.Write(packMsg(tMsg{"op":"ohi", "from":aFrom, "status":aStat}, nil))
       if err != nil {
-         fmt.Fprintf(os.Stderr, "%s queue._tryOhi write error %s\n", o._logNode(), err)
+         fmt.Fprintf(os.Stderr, "%s queue._sendOhiHeld write error %s\n", o._logNode(), err)
+         return
       }
-   default: // drop msg
    }
 }
 
 func _runQueue(o *tQueue) {
    aMsgId := o._waitForMsg()
-   var aConn net.Conn
-   for {
-   WaitConn:
-      select {
-         case aOhi := <-o.ohi:
-            o._tryOhi(&aOhi)
-            goto WaitConn
-         case aConn = <-o.connChan:
+   for aMsgId != "" {
+      err := sStore.checkHead(o.node, aMsgId)
+      if err != nil {
+         if _, ok := err.(*os.PathError); !ok {
+            fmt.Fprintf(os.Stderr, "%s queue._runQueue quarantine %s %s\n", o._logNode(), aMsgId, err)
+            err = sStore.quarantine(o.node, aMsgId)
+            if err != nil && !os.IsNotExist(err) { panic(err) }
+            aMsgId = o._waitForMsg()
+            continue
+         } // else sendFile handles it
+      }
+      aConn := o._waitForDelivery()
+      if aConn == nil {
+         break
+      }
+      if _, ok := aConn.(*tChunkConn); ok {
+         o.connChan <- aConn // taken for each chunk, so other msgs may interleave
+         err = sStore.sendFile(o.node, aMsgId, &tQueueWriter{queue:o, conn:aConn})
+      } else {
+         err = sStore.sendFile(o.node, aMsgId, aConn)
+         o.connChan <- aConn
       }
-      err := sStore.sendFile(o.node, aMsgId, aConn)
-      o.connChan <- aConn
       if err != nil {
+         if os.IsNotExist(err) { // node dropped
+            fmt.Fprintf(os.Stderr, "%s queue._runQueue sendfile missing %s\n", o._logNode(), aMsgId)
+            aMsgId = o._waitForMsg()
+            continue
+         }
          if _, ok := err.(*os.PathError); ok { panic(err) } //todo move to sStore?
          //todo recoverable?
          fmt.Fprintf(os.Stderr, "%s queue._runQueue sendfile error %s\n", o._logNode(), err)
@@ -1093,25 +2399,59 @@ func _runQueue(o *tQueue) {
          aMsgId = o._waitForMsg()
       case <-o.off:
          aTimeout.Stop()
+      case <-o.done:
+         aTimeout.Stop()
+         aMsgId = ""
       case <-aTimeout.C:
          fmt.Fprintf(os.Stderr, "%s queue._runQueue timed out awaiting ack %s\n", o._logNode(), aMsgId)
       }
    }
 }
 
+type tQueueWriter struct { // tmtprev 2: writes queue deliveries in chunks
+   queue *tQueue
+   conn net.Conn // link at start of delivery
+}
+
+func (o *tQueueWriter) Write(iBuf []byte) (int, error) {
+   aLen := 0
+   for aLen < len(iBuf) {
+      aEnd := aLen + kChunkMax; if aEnd > len(iBuf) { aEnd = len(iBuf) }
+      aConn := o.queue._waitForConn()
+      if aConn != o.conn {
+         if aConn == nil {
+            return aLen, tError("node dropped during delivery")
+         }
+         o.queue.connChan <- aConn
+         return aLen, tError("link changed during delivery")
+      }
+      _, err := aConn.(*tChunkConn).writeTag(kTagQueue, iBuf[aLen:aEnd])
+      o.queue.connChan <- aConn
+      if err != nil { return aLen, err }
+      aLen = aEnd
+   }
+   return aLen, nil
+}
+
 func _runElasticChan(o *tQueue) {
    var aS string
    var ok bool
    for {
       // buf needs a value to let select multiplex consumer & producer
       if len(o.buf) == 0 {
-         aS, ok = <-o.in
+         select {
+         case aS, ok = <-o.in:
+         case <-o.done:
+            return
+         }
          if !ok { goto closed }
          o.buf = append(o.buf, aS)
          sort.Strings(o.buf)
       }
 
       select {
+      case <-o.done:
+         return
       case aS, ok = <-o.in:
          if !ok { goto closed }
          o.buf = append(o.buf, aS)
@@ -1139,31 +2479,40 @@ func makeUid() string {
    return sBase32.EncodeToString(aData[:])
 }
 
-func makeNodeId() (aNodeId, aSha string) {
+// return node id for client, and node secret it encodes, which the user database hashes
+func makeNodeId() (aNodeId, aSecret string) {
    aData := make([]byte, kNodeIdLen)
    _, err := rand.Read(aData)
    if err != nil { panic(err) }
    aNodeId = sBase32.EncodeToString(aData)
-   aSha = _node2sha(aData)
-   return aNodeId, aSha
+   return aNodeId, string(aData)
 }
 
-func getNodeSha(iNode *string) (string, error) {
-   aData, err := sBase32.DecodeString(*iNode)
-   if err != nil { return "", err }
-   aSha := _node2sha(aData)
-   *iNode = "" //todo erase the internal array?
-   return aSha, nil
+// make recovery code for client, and its secret for user database
+func makeRecovery() (aCode, aSecret string) {
+   aData := make([]byte, 20)
+   _, err := rand.Read(aData)
+   if err != nil { panic(err) }
+   return sBase32.EncodeToString(aData), string(aData)
 }
 
-func _node2sha(iNode []byte) string {
-   aData := sha256.Sum256(iNode)
-   for a:=0; a < 22388; a++ { //todo per-user count?
-      aData = sha256.Sum256(aData[:]) //todo alternate algorithm
+// make node id & its secret for user database; with a PAKE record, the id is the key, and is not secret
+func makeNode(iSalt, iVerifier string) (aNodeId, aKey string, aPake []byte, err error) {
+   if iVerifier == "" {
+      aNodeId, aKey = makeNodeId()
+      return aNodeId, aKey, nil, nil
    }
-   aText := sBase32.EncodeToString(aData[:])
-   if aText[len(aText)-4] != '=' { panic("padding less than 4") } //todo temp
-   return aText[:len(aText)-4] // omit padding
+   aPake, err = makePakeRecord(iSalt, iVerifier)
+   if err != nil { return "", "", nil, err }
+   aNodeId = makeNodeRef()
+   return aNodeId, aNodeId, aPake, nil
+}
+
+func getNodeSecret(iNode *string) (string, error) {
+   aData, err := sBase32.DecodeString(*iNode)
+   if err != nil { return "", err }
+   *iNode = "" //todo erase the internal array?
+   return string(aData), nil
 }
 
 func _logNode(i string) string { return _logTime() + i[:7] + i[len(i)-3:] }
@@ -1175,15 +2524,21 @@ type tStore struct { // queue and msg storage
    Root string // top-level directory
    temp string // msg files land here before hardlinks land in queue directories
    nextId uint64 // incrementing msg filename
+   key []byte // derives msg file keys; nil if msg files are plaintext
+   usage map[string]int64 // octets queued per uid, summed over its node directories
+   reserved map[string]int64 // octets being queued per uid, counted against quota
+   usageDoor sync.Mutex
 }
 
-func Init(iMain string, iTime time.Time) {
+func Init(iMain string, iTime time.Time, iKey []byte) error {
    o := &sStore
    o.Root = iMain + "/"
    o.temp = o.Root + "temp/"
 
    err := os.MkdirAll(o.temp, 0700)
    if err != nil { panic(err) }
+   err = o.openCrypt(iKey)
+   if err != nil { return err }
    aFd, err := os.Open(o.temp)
    if err != nil { panic(err) }
    aTmps, err := aFd.Readdirnames(0)
@@ -1198,32 +2553,75 @@ func Init(iMain string, iTime time.Time) {
       iTime = time.Now() // only for test runs
    }
    o.nextId = uint64(iTime.UnixNano())
+
+   o.usage = make(map[string]int64)
+   o.reserved = make(map[string]int64)
+   aNodes, err := o._nodeDirs()
+   if err != nil { panic(err) }
+   for _, aNode := range aNodes {
+      aLen, err := o._dirSize(aNode)
+      if err != nil { panic(err) }
+      o._addUsage(aNode, aLen)
+   }
+
+   if sLimits.NodeRemind != 0 || sLimits.NodeExpire != 0 {
+      go _runSweeper()
+   }
+   return nil
 }
 
 func (o *tStore) makeId() string {
    return fmt.Sprintf("%016x", atomic.AddUint64(&o.nextId, 1))
 }
 
-func (o *tStore) recvFile(iId string, iHead, iData []byte, iStream io.Reader, iLen int64) error {
+// write msg file; if iSum != 0, data must match it
+func (o *tStore) recvFile(iId string, iHead, iData []byte, iStream io.Reader, iLen int64, iSum uint64) error {
    aFd, err := os.OpenFile(o.temp+iId, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
    if err != nil { return err }
    defer aFd.Close()
-   _,err = aFd.Write(iHead)
+   var aFile io.Writer = aFd
+   var aSeal *tSealWriter
+   if o.key != nil {
+      aSeal, err = o._newSealWriter(aFd)
+      if err != nil { return err }
+      aFile = aSeal
+   }
+   _,err = aFile.Write(iHead)
    if err != nil { return err }
    for aPos, aLen := 0,0; aPos < len(iData); aPos += aLen {
-      aLen, err = aFd.Write(iData[aPos:])
+      aLen, err = aFile.Write(iData[aPos:])
       if err != nil && err != io.ErrShortWrite { return err }
    }
-   _,err = io.CopyN(aFd, iStream, iLen - int64(len(iData)))
-   if err != nil { return err }
+   aCrc := crc32.New(sCrc32c)
+   aCrc.Write(iData)
+   if iLen > int64(len(iData)) {
+      _,err = io.CopyN(aFile, io.TeeReader(iStream, aCrc), iLen - int64(len(iData)))
+      if err != nil { return err }
+   }
+   if iSum != 0 && uint64(aCrc.Sum32()) != iSum {
+      return sErrDataSum
+   }
+   if aSeal != nil {
+      err = aSeal.close()
+      if err != nil { return err }
+   }
    err = aFd.Sync()
    return err
 }
 
+func (o *tStore) tempSize(iId string) (int64, error) {
+   aFi, err := os.Stat(o.temp+iId)
+   if err != nil { return 0, err }
+   return aFi.Size(), nil
+}
+
 func (o *tStore) zeroFile(iNode, iId string) error {
+   aFi, err := os.Lstat(o._nodeSub(iNode)+"/"+iId)
+   if err != nil { return err }
    aFd, err := os.OpenFile(o._nodeSub(iNode)+"/"+iId, os.O_WRONLY|os.O_TRUNC, 0600)
    if err != nil { return err }
    aFd.Close()
+   o._addUsage(iNode, -aFi.Size())
    return nil
 }
 
@@ -1236,6 +2634,9 @@ func (o *tStore) putLink(iSrc, iNode, iId string) error {
       if !os.IsExist(err) { return err }
       return nil
    }
+   aLen, err := o.tempSize(iSrc)
+   if err != nil { return err }
+   o._addUsage(iNode, aLen)
    err = o._syncDirs(iNode)
    return err
 }
@@ -1245,13 +2646,172 @@ func (o *tStore) rmFile(iId string) error {
 }
 
 func (o *tStore) rmLink(iNode, iId string) error {
-   return os.Remove(o._nodeSub(iNode)+"/"+iId)
+   aPath := o._nodeSub(iNode)+"/"+iId
+   aFi, err := os.Lstat(aPath)
+   if err != nil { return err }
+   err = os.Remove(aPath) // fails if another caller removed it first
+   if err != nil { return err }
+   o._addUsage(iNode, -aFi.Size())
+   return nil
 }
 
 func (o *tStore) rmDir(iNode string) error {
-   err := os.Remove(o._nodeSub(iNode))
-   if os.IsNotExist(err) { return nil }
-   return err
+   aLen, err := o._dirSize(iNode)
+   if err != nil { return err }
+   err = os.RemoveAll(o._nodeSub(iNode))
+   if err != nil { return err }
+   o._addUsage(iNode, -aLen)
+   return nil
+}
+
+// remove oldest default-priority msgs queued for iNodes until iLen more fits in iMax, and reserve it
+func (o *tStore) dropOld(iUid string, iNodes []string, iLen, iMax int64) (aDropped []tMsg, err error) {
+   type tItem struct { node, id string }
+   var aList []tItem
+   for _, aNode := range iNodes {
+      aFd, err := os.Open(o._nodeSub(aNode))
+      if err != nil {
+         if os.IsNotExist(err) { continue }
+         return nil, err
+      }
+      aDir, err := aFd.Readdirnames(0)
+      aFd.Close()
+      if err != nil { return nil, err }
+      for _, aId := range aDir {
+         if aId[0] == kPrioDefault {
+            aList = append(aList, tItem{node:aNode, id:aId})
+         }
+      }
+   }
+   sort.Slice(aList, func(cA, cB int) bool { return aList[cA].id < aList[cB].id })
+   aDone := make(map[string]bool) // msgids already reported
+   for a := 0; !o.reserve(iUid, iLen, iMax); a++ {
+      if a == len(aList) {
+         return aDropped, tError("recipient queue exceeds quota")
+      }
+      var aHead tMsg
+      aHead, err = o.getHead(aList[a].node, aList[a].id)
+      if err != nil {
+         if os.IsNotExist(err) { continue } // delivered meanwhile
+         return aDropped, err
+      }
+      if !isFromOther(iUid, aHead) { // keep server & self msgs
+         continue
+      }
+      err = o.rmLink(aList[a].node, aList[a].id)
+      if err != nil {
+         if os.IsNotExist(err) { continue }
+         return aDropped, err
+      }
+      fmt.Printf("%s - quota dropped %s\n", _logNode(aList[a].node), aList[a].id)
+      if aMsgId := bounceId(aHead); !aDone[aMsgId] {
+         aDone[aMsgId] = true
+         aDropped = append(aDropped, aHead)
+      }
+   }
+   return aDropped, nil
+}
+
+func (o *tStore) getUsage(iUid string) int64 {
+   o.usageDoor.Lock()
+   defer o.usageDoor.Unlock()
+   return o.usage[strings.ToLower(iUid)]
+}
+
+// count iLen against iUid's quota if it fits in iMax; caller must unreserve after queuing
+func (o *tStore) reserve(iUid string, iLen, iMax int64) bool {
+   aUid := strings.ToLower(iUid)
+   o.usageDoor.Lock()
+   defer o.usageDoor.Unlock()
+   if o.usage[aUid] + o.reserved[aUid] + iLen > iMax {
+      return false
+   }
+   o.reserved[aUid] += iLen
+   return true
+}
+
+func (o *tStore) unreserve(iUid string, iLen int64) {
+   aUid := strings.ToLower(iUid)
+   o.usageDoor.Lock()
+   o.reserved[aUid] -= iLen
+   if o.reserved[aUid] <= 0 {
+      delete(o.reserved, aUid)
+   }
+   o.usageDoor.Unlock()
+}
+
+func (o *tStore) _addUsage(iNode string, iLen int64) {
+   aUid := strings.ToLower(iNode)
+   if a := strings.LastIndexByte(aUid, '.'); a >= 0 {
+      aUid = aUid[:a]
+   }
+   o.usageDoor.Lock()
+   o.usage[aUid] += iLen
+   if o.usage[aUid] <= 0 {
+      delete(o.usage, aUid)
+   }
+   o.usageDoor.Unlock()
+}
+
+// return nodes whose oldest queued msg predates iBefore, with the time of that msg
+func (o *tStore) getQuiet(iBefore time.Time) (map[string]time.Time, error) {
+   aNodes, err := o._nodeDirs()
+   if err != nil { return nil, err }
+   aQuiet := make(map[string]time.Time)
+   for _, aNode := range aNodes {
+      aDir, err := ioutil.ReadDir(o._nodeSub(aNode))
+      if err != nil {
+         if os.IsNotExist(err) { continue } // dropped meanwhile
+         return nil, err
+      }
+      var aTime time.Time
+      for _, aFi := range aDir { // links share mtime of the msg file
+         if aTime.IsZero() || aFi.ModTime().Before(aTime) {
+            aTime = aFi.ModTime()
+         }
+      }
+      if aTime.IsZero() || !aTime.Before(iBefore) {
+         continue
+      }
+      aDot := strings.LastIndexByte(aNode, '.')
+      if aDot < 0 {
+         continue
+      }
+      aQuiet[strings.ToUpper(aNode[:aDot]) + aNode[aDot:]] = aTime // uid chars are uppercase
+   }
+   return aQuiet, nil
+}
+
+func (o *tStore) _nodeDirs() ([]string, error) {
+   aSubs, err := ioutil.ReadDir(o.Root)
+   if err != nil { return nil, err }
+   var aList []string
+   for _, aSub := range aSubs {
+      if !aSub.IsDir() || aSub.Name() == "temp" || aSub.Name() == "quarantine" {
+         continue
+      }
+      aNodes, err := ioutil.ReadDir(o.Root + aSub.Name())
+      if err != nil { return nil, err }
+      for _, aNode := range aNodes {
+         if aNode.IsDir() {
+            aList = append(aList, aNode.Name())
+         }
+      }
+   }
+   return aList, nil
+}
+
+func (o *tStore) _dirSize(iNode string) (int64, error) {
+   aList, err := ioutil.ReadDir(o._nodeSub(iNode))
+   if err != nil {
+      if os.IsNotExist(err) { err = nil }
+      return 0, err
+   }
+   var aLen int64
+   for _, aFi := range aList {
+      aLen += aFi.Size()
+   }
+   return aLen, nil
 }
 
 func (o *tStore) _syncDirs(iNode string) error {
@@ -1271,14 +2831,61 @@ func (o *tStore) _syncDirs(iNode string) error {
    return err
 }
 
-func (o *tStore) sendFile(iNode, iId string, iConn net.Conn) error {
-   aFd, err := os.Open(o._nodeSub(iNode)+"/"+iId)
+func (o *tStore) sendFile(iNode, iId string, iConn io.Writer) error {
+   aFd, aFile, err := o._openFile(o._nodeSub(iNode)+"/"+iId)
    if err != nil { return err }
    defer aFd.Close()
-   _,err = io.Copy(iConn, aFd) // calls iConn.Write() repeatedly
+   _,err = io.Copy(iConn, aFile) // calls iConn.Write() repeatedly
    return err
 }
 
+func (o *tStore) getHead(iNode, iId string) (tMsg, error) {
+   aFd, aFile, err := o._openFile(o._nodeSub(iNode)+"/"+iId)
+   if err != nil { return nil, err }
+   defer aFd.Close()
+   aLen := make([]byte, 4)
+   _, err = io.ReadFull(aFile, aLen)
+   if err != nil { return nil, err }
+   aHeadLen, err := strconv.ParseUint(string(aLen), 16, 16)
+   if err != nil { return nil, err }
+   aBuf := make([]byte, aHeadLen)
+   _, err = io.ReadFull(aFile, aBuf)
+   if err != nil { return nil, err }
+   var aHead tMsg
+   aDec := json.NewDecoder(bytes.NewReader(aBuf))
+   aDec.UseNumber() // preserve numbers for checkHead
+   err = aDec.Decode(&aHead)
+   return aHead, err
+}
+
+// verify headsum & from; any error but *os.PathError means the file is corrupt
+func (o *tStore) checkHead(iNode, iId string) error {
+   aHead, err := o.getHead(iNode, iId)
+   if err != nil { return err }
+   aSum, _ := aHead["headsum"].(json.Number)
+   delete(aHead, "headsum")
+   if string(aSum) != fmt.Sprint(crc32.Checksum(packMsg(aHead, nil), sCrc32c)) {
+      return tError("headsum does not match header")
+   }
+   if aFrom, _ := aHead["from"].(string); aFrom == "" {
+      return tError("from header missing")
+   }
+   return nil
+}
+
+// move a corrupt msg out of the queue, for inspection by admin
+func (o *tStore) quarantine(iNode, iId string) error {
+   aPath := o._nodeSub(iNode)+"/"+iId
+   aFi, err := os.Lstat(aPath)
+   if err != nil { return err }
+   err = os.MkdirAll(o.Root+"quarantine", 0700)
+   if err != nil { return err }
+   err = os.Rename(aPath, o.Root+"quarantine/"+strings.ToLower(iNode)+"_"+iId)
+   if err != nil { return err }
+   o._addUsage(iNode, -aFi.Size())
+   return o._syncDirs(iNode)
+}
+
 func (o *tStore) getDir(iNode string) ([]string, error) {
    fmt.Printf("%s - read dir %s\n", _logNode(iNode), o._nodeSub(iNode))
    aFd, err := os.Open(o._nodeSub(iNode))
@@ -1300,10 +2907,18 @@ func (o *tStore) copyDir(iNode, iToNode string) error {
    }
    err = os.MkdirAll(o._nodeSub(iToNode), 0700)
    if err != nil { return err }
+   var aLen int64
    for _, aId := range aDir {
       err = os.Link(o._nodeSub(iNode)+"/"+aId, o._nodeSub(iToNode)+"/"+aId)
-      if err != nil && !os.IsNotExist(err) && !os.IsExist(err) { return err }
+      if err != nil {
+         if !os.IsNotExist(err) && !os.IsExist(err) { return err }
+         continue
+      }
+      aFi, err := os.Lstat(o._nodeSub(iToNode)+"/"+aId)
+      if err != nil { return err }
+      aLen += aFi.Size()
    }
+   o._addUsage(iToNode, aLen)
    err = o._syncDirs(iToNode)
    return err
 }
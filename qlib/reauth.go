@@ -0,0 +1,145 @@
+// Copyright 2026 Liam Breck
+// Published at https://github.com/networkimprov/mnm
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package qlib
+
+import (
+   "fmt"
+   "os"
+   "time"
+)
+
+// A node may be made to reauthenticate, i.e. show the user is present, by an OpenID token
+// for the user's registered identity or by the user's second-factor secret. At login, the
+// server may issue a reauth challenge in the login response, and hold delivery from the
+// node's queue until the client answers with a Reauth request. Login policies are: an
+// admin's request (a per-node flag in UserDatabase), an address not in the user's login
+// history, and a node idle for some days. Certain requests may also need a reauthentication
+// within kReauthLife; they're rejected with a challenge in the ack. For a user with neither
+// identity nor second factor, the challenge lists no methods, so delivery stays held (and
+// requests are rejected) until the user sets a second factor, which a held node may do.
+// Setting a first factor is not itself challenged.
+
+const kReauthLife = 10 * time.Minute // a reauth satisfies requests for this long
+
+type TReauth struct {
+   NewAddr bool     `json:"newaddr"` // at login from address not in user's history
+   Idle    int      `json:"idle"`    // at login after days since node's prior login; 0 for never
+   Ops     []string `json:"ops"`     // requests needing a recent reauth
+}
+
+// requests without data, so one can be dropped before reading it
+var sReauthOpNames = map[string]uint8{
+   "useredit": eOpUserEdit, "ohiedit": eOpOhiEdit, "groupedit": eOpGroupEdit,
+   "listnodes": eOpListNodes, "listlogins": eOpListLogins,
+}
+
+var sReauth = struct {
+   TReauth
+   ops map[uint8]bool
+}{ ops: map[uint8]bool{} }
+
+func SetReauthPolicy(iPolicy TReauth) error {
+   if iPolicy.Idle < 0 {
+      return tError("reauth.idle must be >= 0")
+   }
+   aOps := map[uint8]bool{}
+   for _, aName := range iPolicy.Ops {
+      aOp, ok := sReauthOpNames[aName]
+      if !ok {
+         return tError(fmt.Sprintf("reauth.ops has unknown op %q", aName))
+      }
+      aOps[aOp] = true
+   }
+   sReauth.TReauth, sReauth.ops = iPolicy, aOps
+   return nil
+}
+
+// return reason node must reauthenticate at login, or ""
+func reauthLogin(iDue, iNewAddr bool, iPrior int64) string {
+   switch {
+   case iDue:
+      return "admin"
+   case iNewAddr && sReauth.NewAddr:
+      return "newaddr"
+   case iPrior != 0 && sReauth.Idle > 0 && time.Since(time.Unix(iPrior, 0)) >= _days(sReauth.Idle):
+      return "idle"
+   }
+   return ""
+}
+
+// return challenge listing methods available to user, maybe none; renews nonce for OpenID
+func (o *tLink) _reauthChallenge(iUid string, iFactor bool, iWhy string) tMsg {
+   aBy := []string{}
+   if sAuthType != 0 {
+      aAuth, err := UDb.GetAuth(iUid)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._reauthChallenge %s\n", o._logNode(), err)
+      }
+      if aIss, _ := aAuth["Issuer"].(string); aIss != "" {
+         aBy = append(aBy, "oidc")
+      }
+   }
+   if iFactor {
+      aBy = append(aBy, "factor")
+   }
+   aMsg := tMsg{"why":iWhy, "by":aBy}
+   if len(aBy) > 0 && aBy[0] == "oidc" {
+      o.nonce = makeNonceOpenid()
+      aMsg["nonce"] = o.nonce
+   }
+   return aMsg
+}
+
+// return challenge if request needs a recent reauthentication, else nil
+func (o *tLink) _reauthOp(iHead *tHeader) tMsg {
+   if !sReauth.ops[iHead.Op] && !(iHead.Op == eOpUserEdit && iHead.NewFactor != "") ||
+      time.Since(o.reauthAt) < kReauthLife {
+      return nil
+   }
+   _, aFactor, err := UDb.GetReauth(o.uid, o.node)
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "%s link._reauthOp %s\n", o._logNode(), err)
+      return nil
+   }
+   aMsg := o._reauthChallenge(o.uid, aFactor, "op")
+   if len(aMsg["by"].([]string)) == 0 && iHead.NewFactor != "" {
+      return nil // user's first method
+   }
+   return aMsg
+}
+
+// verify OpenID token or second factor; release held delivery
+func (o *tLink) _reauth(iHead *tHeader) *tMsgQuit {
+   var err error
+   if iHead.Oidc != nil {
+      if iHead.Oidc.Id_token == "" { // refresh token doesn't show user is present
+         return sMsgReauthFailure
+      }
+      _, aQuit := o._checkAuth(o.uid, iHead.Oidc)
+      if aQuit != nil {
+         fmt.Fprintf(os.Stderr, "%s link._reauth %s\n", o._logNode(), aQuit.Error)
+         return sMsgReauthFailure
+      }
+   } else {
+      err = UDb.VerifyFactor(o.uid, iHead.Factor)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s link._reauth %s\n", o._logNode(), err)
+         return sMsgReauthFailure
+      }
+   }
+   o.nonce = makeNonceOpenid() // token is single use
+   o.reauthAt = time.Now()
+   err = UDb.SetReauth(o.uid, o.node, false)
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "%s link._reauth %s\n", o._logNode(), err)
+   }
+   o.queue.ackAsap(iHead.Id, "", "", nil, nil)
+   o.queue.hold(false)
+   fmt.Printf("%s - reauth\n", o._logNode())
+   return nil
+}
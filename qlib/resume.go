@@ -0,0 +1,74 @@
+// Copyright 2026 Liam Breck
+// Published at https://github.com/networkimprov/mnm
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package qlib
+
+import (
+   "crypto/rand"
+   "crypto/sha256"
+   "sync"
+   "time"
+)
+
+// A resume token lets a node log in again without its secret, which skips the costly hash
+// of a password, or the PAKE exchange. Each login issues a token for the node, replacing
+// any prior one; a token is good for one login within kResumeLife. Tokens are kept only
+// in memory, indexed by hash, so a restart or dropped node revokes them.
+
+const kResumeLen = 20
+const kResumeLife = 24 * time.Hour
+
+type tResumeKey [sha256.Size]byte
+
+type tResume struct {
+   uid, node string
+   expires time.Time
+}
+
+var sResume = struct {
+   sync.Mutex
+   token map[tResumeKey]tResume
+   node map[string]tResumeKey // indexed by node id
+}{ token: make(map[tResumeKey]tResume), node: make(map[string]tResumeKey) }
+
+func makeResume(iUid, iNode string) string {
+   aData := make([]byte, kResumeLen)
+   _, err := rand.Read(aData)
+   if err != nil { panic(err) }
+   aKey := tResumeKey(sha256.Sum256(aData))
+   sResume.Lock(); defer sResume.Unlock()
+   if aOld, ok := sResume.node[iNode]; ok {
+      delete(sResume.token, aOld)
+   }
+   sResume.token[aKey] = tResume{uid: iUid, node: iNode, expires: time.Now().Add(kResumeLife)}
+   sResume.node[iNode] = aKey
+   return sBase32.EncodeToString(aData)
+}
+
+// return node id for token, and revoke it
+func useResume(iUid string, iToken []byte) (string, error) {
+   aKey := tResumeKey(sha256.Sum256(iToken))
+   sResume.Lock(); defer sResume.Unlock()
+   aRes, ok := sResume.token[aKey]
+   if !ok || aRes.uid != iUid {
+      return "", tError("resume token invalid")
+   }
+   delete(sResume.token, aKey)
+   delete(sResume.node, aRes.node)
+   if time.Now().After(aRes.expires) {
+      return "", tError("resume token expired")
+   }
+   return aRes.node, nil
+}
+
+func dropResume(iNode string) {
+   sResume.Lock(); defer sResume.Unlock()
+   if aKey, ok := sResume.node[iNode]; ok {
+      delete(sResume.token, aKey)
+      delete(sResume.node, iNode)
+   }
+}
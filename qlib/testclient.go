@@ -9,11 +9,21 @@ package qlib
 
 import (
    "sync/atomic"
+   "encoding/base64"
+   "encoding/binary"
+   "crypto"
+   "crypto/ecdsa"
+   "crypto/ed25519"
+   "crypto/elliptic"
+   "crypto/rand"
+   "crypto/rsa"
+   "crypto/sha256"
    "hash/crc32"
    "fmt"
    "io"
    "encoding/json"
    "net"
+   "net/http"
    "os"
    "os/signal"
    "strconv"
@@ -24,9 +34,15 @@ import (
 
 
 const kTestLoginWait time.Duration = 6 * time.Second
+const kTestChunkWait time.Duration = 2 * time.Second // limit on awaiting results of chunked input
+const kTestAuthMax = 100 // verify pass registers many users with one identity
 
 var sTestNodeIds = make(map[int][]string)
-var sTestVerifyAuthToken *tOpenidToken
+var sTestResume = struct { sync.Mutex; token map[string]string }{ token: make(map[string]string) } // indexed by node
+var sTestVerifyOidc = make(map[string]func() *tOpenidToken) // make tokens for "*xyz" in .Oidc at send time
+var sTestVerifyAuth func(byte, int) // sets site auth type & limits.authmax
+var sTestPake *tPakeClient
+var sTestPakeM2 string // proof expected from server
 var sTestVerifyWork []tTestWork
 var sTestVerifyDone = make(chan int)
 var sTestVerifyOp int
@@ -34,7 +50,10 @@ var sTestVerifyNfsn bool
 var sTestVerifyWant struct { val string; sync.Mutex } // expected results
 var sTestVerifyGot [3]string // actual results: response to sender, msg to sender, msg to receiver
 var sTestVerifyGotNode = make(map[int]string) // actual results at nodes
+var sTestVerifyGotSig = make(chan bool, 1) // written after a result is recorded
+var sTestVerifyVal = make(map[string]string) // results to substitute for "*xyz" in later requests
 var sTestVerifyFail int
+var sTestSweepReminded = make(map[string]time.Time)
 var sTestClientCount int32
 var sTestClientId chan [3]int
 var sTestLogins = make(map[int]*int)
@@ -55,6 +74,14 @@ func LocalTest(i int) {
    UDb.TempAlias("u100002", "test11")
    UDb.TempAlias("u100003", "test2")
    UDb.TempGroup("blab", "u100002", "test1") // Status eStatInvited
+   err := UDb.SetMsgMax("u100002", 4096)
+   if err != nil { panic(err) }
+   aSalt := []byte("test pake salt..")
+   sTestPake, sTestVerifyVal["*pakea"] = newPakeClient([]byte("test pake secret"))
+   sTestVerifyVal["*pakesalt"] = sBase32.EncodeToString(aSalt)
+   sTestVerifyVal["*pakeverifier"] = pakeVerifier([]byte("test pake secret"), aSalt)
+
+   aIss, aSign := _testOpenidProvider()
 
    aFd, err := os.Open("test.json")
    if err != nil {
@@ -105,6 +132,7 @@ func LocalTest(i int) {
       for a1 := range aWk.Want {
          switch aFrom, _ := aWk.Want[a1]["from"].(string); aFrom {
          case "*senduid": aWk.Want[a1]["from"] = "u100002"
+         case "*recvuid": aWk.Want[a1]["from"] = "u100003"
          }
          fFor(aWk.Want[a1]["for"])
          if aDataSet, _ := aWk.Want[a1]["~data"].([]interface{}); aDataSet != nil {
@@ -114,27 +142,63 @@ func LocalTest(i int) {
             aWk.Want[a1]["~data"] = a1
          }
       }
-      aBuf, err := json.Marshal(aWk.Want)
-      if err != nil {
-         fmt.Fprintf(os.Stderr, "test.json %s\n", err)
-         return
+      aWants := make([]string, len(aWk.Want)) // one per line; may contain lists of objects
+      for a1 := range aWk.Want {
+         aBuf, err := json.Marshal(aWk.Want[a1])
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "test.json %s\n", err)
+            return
+         }
+         aWants[a1] = string(aBuf)
       }
-      aWk.wants = strings.ReplaceAll(string(aBuf[1:len(aBuf)-1]), "},{", "}\n{")
+      aWk.wants = strings.Join(aWants, "\n")
       aWk.wants = strings.ReplaceAll(aWk.wants, `"headsum":1`, `"headsum":#sck#`)
       aWk.wants = strings.ReplaceAll(aWk.wants, `"headsum":2`, `"headsum":#ck#`)
+      aWk.wants = strings.ReplaceAll(aWk.wants, "*oidciss", aIss)
       for a1 := range aData {
          if aData[a1] == "" { continue }
          aWk.wants = strings.Replace(aWk.wants, `,"~data":`+ fmt.Sprint(a1) +`}`, `}`+ aData[a1], 1)
       }
    }
 
-   sTestVerifyAuthToken = enableTestOpenid()
-   SetTmtpRev("Verify", 1, []TAuthBy{{Label:"X",
-                                      Login:[]string{"https://example.com/l", "a", "b"},
-                                      Token:[]string{"https://example.com/t", "c"},
-                                      Std:  []string{"d"},
-                                      Keys: "http://localhost:8080/keys",
-                                      Iss:  "issuer", Aud: "audience"}})
+   aNow := time.Now()
+   fSign := func(cKid string, cClaims tMsg) func() *tOpenidToken { // token gives link's nonce
+      return func() *tOpenidToken {
+         cSet := tMsg{"nonce": sTestVerifyVal["*nonce"]}
+         for cK, cV := range cClaims { cSet[cK] = cV }
+         return aSign(cKid, cSet)
+      }
+   }
+   sTestVerifyOidc["*oidcnonce"] = fSign("kid0", nil)
+   sTestVerifyOidc["*oidcnewkey"] = fSign("kid1", nil) // key is in provider's second keys response
+   sTestVerifyOidc["*oidclatekey"] = fSign("kid2", nil) // in third response, so refetch is too soon
+   sTestVerifyOidc["*oidces256"] = fSign("kid-es", nil)
+   sTestVerifyOidc["*oidceddsa"] = fSign("kid-ed", nil)
+   sTestVerifyOidc["*oidcexpired"] = fSign("kid0", tMsg{"exp": aNow.Add(-time.Minute).Unix()})
+   sTestVerifyOidc["*oidcnbf"] = fSign("kid0", tMsg{"nbf": aNow.Add(time.Hour).Unix()})
+   sTestVerifyOidc["*oidciat"] = fSign("kid0", tMsg{"iat": aNow.Add(time.Hour).Unix()})
+   sTestVerifyOidc["*oidcold"] = fSign("kid0", tMsg{"iat": aNow.Add(-time.Hour).Unix()})
+   sTestVerifyOidc["*oidcoldauth"] = fSign("kid0", tMsg{"auth_time": aNow.Add(-time.Hour).Unix()})
+   sTestVerifyOidc["*oidcaudlist"] = fSign("kid0", tMsg{"aud": []string{"other", "audience"}, "azp": "audience"})
+   sTestVerifyOidc["*oidcazp"] = fSign("kid0", tMsg{"aud": []string{"other", "audience"}, "azp": "other"})
+   sTestVerifyOidc["*oidcbadnonce"] = fSign("kid0", tMsg{"nonce": "x"})
+   sTestVerifyOidc["*oidcnononce"] = fSign("kid0", tMsg{"nonce": nil}) // as if replayed from another link
+   sTestVerifyOidc["*oidcother"] = fSign("kid0", tMsg{"sub": "other"})
+   sTestVerifyOidc["*oidcfresh"] = fSign("kid0", tMsg{"sub": "fresh"})
+   sTestVerifyAuth = func(cType byte, cAuthMax int) {
+      if cAuthMax == 0 { cAuthMax = kTestAuthMax }
+      if cType == 0 {
+         SetTmtpRev("Verify", 0, nil, TLimits{MsgMax: 1 << 20})
+         return
+      }
+      SetTmtpRev("Verify", cType, []TAuthBy{{Label:"X",
+                                             Login:[]string{"https://example.com/l", "a", "b"},
+                                             Token:[]string{aIss +"/token", "c"},
+                                             Std:  []string{"d"},
+                                             Iss:  aIss, Aud: "audience"}}, // keys URL by discovery
+                 TLimits{MsgMax: 1 << 20, AuthMax: cAuthMax})
+   }
+   sTestVerifyAuth(1, 0)
    NewLink(_newTestClient(eActVerifyRecv, [3]int{100003, 0, 0}))
    NewLink(_newTestClient(eActVerifyRecv, [3]int{100003, 1, 0}))
    NewLink(_newTestClient(eActVerifyRecv, [3]int{100002, 1, 0}))
@@ -142,7 +206,7 @@ func LocalTest(i int) {
    NewLink(_newTestClient(eActVerifySend, [3]int{100002, 0, 0}))
    <-sTestVerifyDone
    time.Sleep(10 * time.Millisecond)
-   SetTmtpRev("Cycle", 0, nil)
+   SetTmtpRev("Cycle", 0, nil, TLimits{})
    fmt.Fprintf(os.Stderr, "%d verify pass failures, starting cycle\n\n", sTestVerifyFail)
 
    sTestClientCount = int32(i)
@@ -175,18 +239,27 @@ func LocalTest(i int) {
 }
 
 func _testMakeNode(iId, iN int) string {
-   aNodeId, aNodeSha := makeNodeId()
+   aNodeId, aSecret := makeNodeId()
    aSet := sTestNodeIds[iId]
    if aSet == nil {
       aSet = []string{"", "", ""}
    }
    aSet[iN] = aNodeId
    sTestNodeIds[iId] = aSet
-   return aNodeSha
+   return aSecret
 }
 
 type tTestWork struct {
    Tmtp byte    // replay eOpTmtpRev object; other fields ignored
+   Tag byte     // after tmtprev 2, send in chunk with this tag
+   Auth *byte   // set site auth type before sending
+   AuthMax int  // with Auth, set limits.authmax; 0 for kTestAuthMax
+   Reauth *TReauth // set reauth policy before sending
+   ReauthDue bool  // before sending, require nodes of last registered user to reauthenticate
+   Sweep int    // before sending, sweep nodes of last registered user as if days passed;
+                // noderemind 2, nodeexpire 4
+   Quota *int64 // set limits.quota before sending; 0 for no limit
+   QuotaPolicy string // with Quota, set limits.quotapolicy
    Msg string   // send this; ignore Head & Data
    Head tMsg    // send this combined with Data or Datb
    Data string  // if set, ignore Datb
@@ -204,6 +277,8 @@ var kOpSet = map[string]int{
    "eOpPost": eOpPost, "eOpPostNotify": eOpPostNotify, "eOpPing": eOpPing,
    "eOpAck": eOpAck,
    "eOpPulse": eOpPulse, "eOpQuit": eOpQuit,
+   "eOpSetFlag": eOpSetFlag, "eOpRecover": eOpRecover, "eOpPair": eOpPair,
+   "eOpListNodes": eOpListNodes, "eOpListLogins": eOpListLogins, "eOpReauth": eOpReauth,
 }
 
 type tTestClient struct {
@@ -215,6 +290,9 @@ type tTestClient struct {
    ack chan string // writer tells reader to issue ack to qlib
    closed bool // when about to shut down
    readDeadline time.Time // set by qlib
+   chunked bool // tmtprev 2 negotiated
+   resumeNode string // node of login, to store resume token
+   readPend []byte // msg remainder that didn't fit the last Read buffer
 }
 
 type tTestAction int
@@ -226,6 +304,14 @@ func _newTestClient(iAct tTestAction, iInfo [3]int) *tTestClient {
 }
 
 func (o *tTestClient) Read(iBuf []byte) (int, error) {
+   if o.closed {
+      return 0, io.EOF
+   }
+   if len(o.readPend) > 0 {
+      aLen := copy(iBuf, o.readPend)
+      o.readPend = o.readPend[aLen:]
+      return aLen, nil
+   }
    if o.action == eActCycle {
       return o._cycleRead(iBuf)
    }
@@ -234,6 +320,7 @@ func (o *tTestClient) Read(iBuf []byte) (int, error) {
 
 func (o *tTestClient) _verifyRead(iBuf []byte) (int, error) {
    var aMsg []byte
+   var aTag byte
 
    if o.action == eActVerifyRecv {
       o.count++
@@ -249,12 +336,26 @@ func (o *tTestClient) _verifyRead(iBuf []byte) (int, error) {
             aMsg = packMsg(tMsg{"Op":eOpAck, "Id":aId, "Type":"n"}, nil)
          }
       }
+   } else if o.chunked && sTestVerifyOp == eOpQuit {
+      return 0, io.EOF // _runChunks reads ahead; next link sends next msg
    } else {
-      time.Sleep(10 * time.Millisecond)
+      if !o.chunked {
+         time.Sleep(10 * time.Millisecond)
+      } else { // chunked input is handled while reading continues; await its results
+         aTmr := time.NewTimer(kTestChunkWait)
+         for aWait := true; aWait && len(o.ack) == 0 && !_testVerifyComplete(o.id); {
+            select {
+            case <-sTestVerifyGotSig:
+            case <-aTmr.C:
+               aWait = false
+            }
+         }
+         aTmr.Stop()
+      }
       select {
       case aId := <-o.ack:
          aMsg = packMsg(tMsg{"Op":eOpAck, "Id":aId, "Type":"n"}, nil)
-         return copy(iBuf, aMsg), nil
+         return o._readOut(iBuf, o._chunk(0, aMsg)), nil
       default:
       }
       aGot := strings.TrimSuffix(strings.Join(sTestVerifyGot[:], ""), "\n")
@@ -263,18 +364,7 @@ func (o *tTestClient) _verifyRead(iBuf []byte) (int, error) {
          fmt.Fprintf(os.Stderr, "Verify FAIL:\n  want: %s\n  got:  %s\n", sTestVerifyWant.val, aGot)
       }
       for aK, aV := range sTestVerifyGotNode {
-         aWant := sTestVerifyGot[2]
-         if aK == o.id { // sender's node
-            if sTestVerifyOp == eOpQuit || sTestVerifyOp == eOpOhiEdit && sTestVerifyNfsn {
-               aWant = ""
-            } else if sTestVerifyOp == eOpGroupInvite {
-               aWant = sTestVerifyGot[2] + sTestVerifyGot[1]
-            } else if sTestVerifyOp == eOpPostNotify {
-               aWant = aWant[strings.LastIndexByte(aWant[:len(aWant)-1], '\n')+1:]
-            } else if sTestVerifyGot[1] != "" && !sTestVerifyNfsn {
-               aWant = sTestVerifyGot[1]
-            }
-         }
+         aWant := _testVerifyNodeWant(o.id, aK)
          aV, aWant = strings.TrimSuffix(aV, "\n"), strings.TrimSuffix(aWant, "\n")
          if aV != aWant {
             sTestVerifyFail++
@@ -288,14 +378,56 @@ func (o *tTestClient) _verifyRead(iBuf []byte) (int, error) {
          return 0, io.EOF
       }
       aWk := sTestVerifyWork[o.count]
+      aTag = aWk.Tag
       sTestVerifyWant.val = aWk.wants
       sTestVerifyOp, _ = aWk.Head["Op"].(int)
       sTestVerifyNfsn = aWk.Nfsn
       o.count++
       aMsg = []byte(aWk.Msg)
+      if aWk.Auth != nil {
+         sTestVerifyAuth(*aWk.Auth, aWk.AuthMax)
+      }
+      if aWk.Reauth != nil {
+         err := SetReauthPolicy(*aWk.Reauth)
+         if err != nil { panic(err) }
+      }
+      if aWk.ReauthDue {
+         err := UDb.SetReauth(sTestVerifyVal["*reguid"], "", true)
+         if err != nil { panic(err) }
+      }
+      if aWk.Quota != nil {
+         sLimits.Quota, sLimits.QuotaPolicy = *aWk.Quota, aWk.QuotaPolicy
+      }
+      if aWk.Sweep != 0 {
+         aLimits := sLimits
+         sLimits.NodeRemind, sLimits.NodeExpire = 2, 4
+         aNow := time.Now().Add(_days(aWk.Sweep))
+         aQuiet, err := getQuiet(aNow.Add(-_days(sLimits.NodeRemind)))
+         if err != nil { panic(err) }
+         for aQid := range aQuiet {
+            if !strings.HasPrefix(aQid, sTestVerifyVal["*reguid"] +".") { delete(aQuiet, aQid) }
+         }
+         sweepNodes(aNow, aQuiet, sTestSweepReminded)
+         sLimits = aLimits
+      }
       if aWk.Msg == "" {
          if sTestVerifyOp == eOpRegister && aWk.Head["Oidc"] == nil {
-            aWk.Head["Oidc"] = sTestVerifyAuthToken
+            aWk.Head["Oidc"] = sTestVerifyOidc["*oidcnonce"]()
+         } else if aS, _ := aWk.Head["Oidc"].(string); sTestVerifyOidc[aS] != nil {
+            aWk.Head["Oidc"] = sTestVerifyOidc[aS]()
+         }
+         for aK, aV := range aWk.Head {
+            if aS, _ := aV.(string); sTestVerifyVal[aS] != "" {
+               aWk.Head[aK] = sTestVerifyVal[aS]
+            }
+         }
+         if aFor, _ := aWk.Head["For"].([]interface{}); aFor != nil {
+            for _, aEl := range aFor {
+               aTo, _ := aEl.(map[string]interface{})
+               if aS, _ := aTo["Id"].(string); sTestVerifyVal[aS] != "" {
+                  aTo["Id"] = sTestVerifyVal[aS]
+               }
+            }
          }
          aData := aWk.Datb; if aWk.Data != "" { aData = []byte(aWk.Data) }
          aMsg = packMsg(aWk.Head, aData)
@@ -303,7 +435,58 @@ func (o *tTestClient) _verifyRead(iBuf []byte) (int, error) {
          return 0, &net.OpError{Op:"read", Err:&tTimeoutError{}}
       }
    }
-   return copy(iBuf, aMsg), nil
+   return o._readOut(iBuf, o._chunk(aTag, aMsg)), nil
+}
+
+// copy msg to Read buffer, keeping any remainder for next Read
+func (o *tTestClient) _readOut(iBuf, iMsg []byte) int {
+   aLen := copy(iBuf, iMsg)
+   o.readPend = iMsg[aLen:]
+   return aLen
+}
+
+// expected results at node, given results for sender iSender
+func _testVerifyNodeWant(iSender, iNode int) string {
+   aWant := sTestVerifyGot[2]
+   if iNode == iSender { // sender's node
+      if sTestVerifyOp == eOpQuit || sTestVerifyOp == eOpOhiEdit && sTestVerifyNfsn {
+         aWant = ""
+      } else if sTestVerifyOp == eOpGroupInvite {
+         aWant = sTestVerifyGot[2] + sTestVerifyGot[1]
+      } else if sTestVerifyOp == eOpPostNotify {
+         if aWant != "" { // omit for error ack
+            aWant = aWant[strings.LastIndexByte(aWant[:len(aWant)-1], '\n')+1:]
+         }
+      } else if sTestVerifyGot[1] != "" && !sTestVerifyNfsn {
+         aWant = sTestVerifyGot[1]
+      }
+   }
+   return aWant
+}
+
+// whether results match those wanted, at sender, receiver & nodes
+func _testVerifyComplete(iSender int) bool {
+   sTestVerifyWant.Lock()
+   aWant := sTestVerifyWant.val
+   sTestVerifyWant.Unlock()
+   if strings.TrimSuffix(strings.Join(sTestVerifyGot[:], ""), "\n") != aWant {
+      return false
+   }
+   for aK, aV := range sTestVerifyGotNode {
+      if strings.TrimSuffix(aV, "\n") != strings.TrimSuffix(_testVerifyNodeWant(iSender, aK), "\n") {
+         return false
+      }
+   }
+   return true
+}
+
+func (o *tTestClient) _chunk(iTag byte, iMsg []byte) []byte {
+   if !o.chunked {
+      return iMsg
+   }
+   aBuf := make([]byte, 0, kChunkHeadLen + len(iMsg))
+   aBuf = append(aBuf, fmt.Sprintf("%02x%04x", iTag, len(iMsg))...)
+   return append(aBuf, iMsg...)
 }
 
 func (o *tTestClient) _cycleRead(iBuf []byte) (int, error) {
@@ -318,7 +501,7 @@ func (o *tTestClient) _cycleRead(iBuf []byte) (int, error) {
 
    if o.toRead > 0 {
       time.Sleep(3 * time.Millisecond)
-      return copy(iBuf, fGetBuf()), nil
+      return o._readOut(iBuf, fGetBuf()), nil
    }
 
    var aDlC <-chan time.Time
@@ -346,6 +529,13 @@ func (o *tTestClient) _cycleRead(iBuf []byte) (int, error) {
          aHead = tMsg{"Op":eOpTmtpRev, "Id":"1"}
       } else if o.count == 2 {
          aHead = tMsg{"Op":eOpLogin, "Uid":"u"+fmt.Sprint(o.id), "Node":sTestNodeIds[o.id][o.nodeN]}
+         o.resumeNode = fmt.Sprint(o.id, ".", o.nodeN)
+         sTestResume.Lock()
+         if aToken := sTestResume.token[o.resumeNode]; aToken != "" { // used once
+            delete(sTestResume.token, o.resumeNode)
+            aHead = tMsg{"Op":eOpLogin, "Uid":"u"+fmt.Sprint(o.id), "Resume":aToken}
+         }
+         sTestResume.Unlock()
          o.nodeN++; if o.nodeN > o.nodeMax { o.nodeN = 0 }
          *sTestLogins[o.id]++
          _testLoginSummary()
@@ -387,7 +577,7 @@ func (o *tTestClient) _cycleRead(iBuf []byte) (int, error) {
 
    aMsg := packMsg(aHead, aData)
    //fmt.Printf("%d PUT %s\n", o.id, string(aMsg))
-   return copy(iBuf, aMsg), nil
+   return o._readOut(iBuf, aMsg), nil
 }
 
 func _testLoginSummary() {
@@ -410,6 +600,17 @@ func _testRecvSummary(i int) {
 }
 
 func (o *tTestClient) Write(iBuf []byte) (int, error) {
+   if !o.chunked {
+      return o._write(iBuf)
+   }
+   _, err := strconv.ParseUint(string(iBuf[:kChunkHeadLen]), 16, 0) // one chunk per write
+   if err != nil { panic(err) }
+   aLen, err := o._write(iBuf[kChunkHeadLen:])
+   if err != nil { return 0, err }
+   return kChunkHeadLen + aLen, nil
+}
+
+func (o *tTestClient) _write(iBuf []byte) (int, error) {
    fCheckBuf := func(cBuf []byte) {
       if o.action != eActCycle {
          return
@@ -440,6 +641,9 @@ func (o *tTestClient) Write(iBuf []byte) (int, error) {
 
    aOp := aHead["op"].(string)
    if o.action >= eActVerifySend {
+      if aOp == "tmtprev" {
+         o.chunked = aHead["id"] == "2" // server chunks output after this msg
+      }
       aLine := string(iBuf[4:]) + "\n"
       if o.action == eActVerifyRecv && (aOp == "tmtprev" || aOp == "info" || aOp == "login") {
          // skip
@@ -447,22 +651,88 @@ func (o *tTestClient) Write(iBuf []byte) (int, error) {
          sTestVerifyGotNode[o.id] += aLine
       } else {
          aI := 0; if o.action == eActVerifyRecv { aI = 2 }
-         if aHead["msgid"] != nil {
+         if aHead["msgid"] != nil && aOp != "bounce" {
             _testVerifyWantEdit("mid", aHead["msgid"].(string))
             _testVerifyWantEdit("pst", aHead["posted"].(string))
          } else if aHead["from"] != nil && aOp != "ohi" {
             aS := ""; if o.action == eActVerifySend { aS = "s"; aI = 1 }
             _testVerifyWantEdit(aS+"id", aHead["id"].(string))
             _testVerifyWantEdit(aS+"pdt", aHead["posted"].(string))
+            _testVerifyWantEdit(aS+"frm", aHead["from"].(string))
             _testVerifyWantEdit(aS+"ck", fmt.Sprint(uint32(aHead["headsum"].(float64))))
-         } else if aOp == "registered" {
+         } else if aOp == "tmtprev" && aHead["nonce"] != nil {
+            _testVerifyWantEdit("nce", aHead["nonce"].(string))
+            sTestVerifyVal["*nonce"] = aHead["nonce"].(string)
+         } else if aOp == "registered" || aOp == "recovered" || aOp == "paired" {
             _testVerifyWantEdit("uid", aHead["uid"].(string))
+            if aHead["uid"].(string) != sTestVerifyVal["*reguid"] {
+               sTestVerifyVal["*reguidprior"] = sTestVerifyVal["*reguid"]
+            }
+            sTestVerifyVal["*reguid"] = aHead["uid"].(string)
+         } else if aHead["confirm"] != nil {
+            _testVerifyWantEdit("cfm", aHead["confirm"].(string))
+            sTestVerifyVal["*confirm"] = aHead["confirm"].(string)
+         } else if aHead["paircode"] != nil {
+            _testVerifyWantEdit("pcd", aHead["paircode"].(string))
+            sTestVerifyVal["*paircode"] = aHead["paircode"].(string)
+         } else if aHead["nodes"] != nil {
+            for _, aN := range aHead["nodes"].([]interface{}) {
+               aEl := aN.(map[string]interface{})
+               if aEl["created"] != nil {
+                  _testVerifyWantEdit("ndc", aEl["created"].(string))
+               }
+               if aEl["lastlogin"] != nil {
+                  _testVerifyWantEdit("ndl", aEl["lastlogin"].(string))
+               }
+            }
+         } else if aHead["logins"] != nil {
+            for _, aL := range aHead["logins"].([]interface{}) {
+               _testVerifyWantEdit("lgt", aL.(map[string]interface{})["time"].(string))
+            }
          }
          if aHead["nodeid"] != nil {
             _testVerifyWantEdit("nid", aHead["nodeid"].(string))
+            sTestVerifyVal["*regnodeprior"] = sTestVerifyVal["*regnode"]
+            sTestVerifyVal["*regnode"] = aHead["nodeid"].(string)
+            if aOp == "paired" {
+               sTestVerifyVal["*pairnode"] = aHead["nodeid"].(string)
+            }
+         }
+         if aRe, _ := aHead["reauth"].(map[string]interface{}); aRe != nil && aRe["nonce"] != nil {
+            _testVerifyWantEdit("rnc", aRe["nonce"].(string))
+            sTestVerifyVal["*nonce"] = aRe["nonce"].(string)
+         }
+         if aHead["recovery"] != nil {
+            _testVerifyWantEdit("rcv", aHead["recovery"].(string))
+            sTestVerifyVal["*recoveryprior"] = sTestVerifyVal["*recovery"]
+            sTestVerifyVal["*recovery"] = aHead["recovery"].(string)
+         }
+         if aOp == "pake" {
+            aSalt, aB := aHead["salt"].(string), aHead["pakeb"].(string)
+            var aM1 string
+            aM1, sTestPakeM2, err = sTestPake.proofs(aSalt, aB)
+            if err != nil { panic(err) }
+            sTestVerifyVal["*pakem"] = aM1
+            if aSalt == sTestVerifyVal["*pakesalt"] {
+               _testVerifyWantEdit("psl", aSalt)
+            }
+            _testVerifyWantEdit("pkb", aB)
+         } else if aHead["pakem"] != nil && aHead["pakem"].(string) == sTestPakeM2 {
+            _testVerifyWantEdit("pkm", sTestPakeM2)
          }
          if aOp == "notify" {
             _testVerifyWantEdit("pid", aHead["postid"].(string))
+         } else if aOp == "info" && aHead["resume"] != nil {
+            _testVerifyWantEdit("rsm", aHead["resume"].(string))
+            sTestVerifyVal["*resumeprior"] = sTestVerifyVal["*resume"]
+            sTestVerifyVal["*resume"] = aHead["resume"].(string)
+         } else if aOp == "user" && aHead["dropnode"] != nil {
+            _testVerifyWantEdit("dnd", aHead["dropnode"].(string))
+         } else if aOp == "user" && aHead["quietsince"] != nil {
+            _testVerifyWantEdit("qst", aHead["quietsince"].(string))
+         } else if aOp == "bounce" {
+            _testVerifyWantEdit("bid", aHead["msgid"].(string))
+            _testVerifyWantEdit("bpt", aHead["msgposted"].(string))
          }
          sTestVerifyGot[aI] += aLine
       }
@@ -474,6 +744,12 @@ func (o *tTestClient) Write(iBuf []byte) (int, error) {
       //fmt.Printf("%d got %s\n", o.id, string(iBuf))
    }
 
+   if o.action == eActCycle && aOp == "info" && aHead["resume"] != nil {
+      sTestResume.Lock()
+      sTestResume.token[o.resumeNode] = aHead["resume"].(string)
+      sTestResume.Unlock()
+   }
+
    if aOp == "ohi" {
       atomic.AddInt32(&sTestRecvOhi, 1)
    } else if aHead["from"] != nil {
@@ -505,6 +781,12 @@ func (o *tTestClient) Write(iBuf []byte) (int, error) {
       }
    }
 
+   if o.action >= eActVerifySend {
+      select {
+      case sTestVerifyGotSig <- true:
+      default:
+      }
+   }
    if o.closed {
       return 0, &net.OpError{Op:"write", Err:tError("closed")}
    }
@@ -523,6 +805,9 @@ func (o *tTestClient) SetReadDeadline(i time.Time) error {
 }
 
 func (o *tTestClient) Close() error {
+   if o.closed {
+      return nil // closed by qlib before link exit
+   }
    o.closed = true;
    if o.action >= eActVerifySend {
       select {
@@ -552,3 +837,120 @@ func (o *tTimeoutError) Error() string   { return "i/o timeout" }
 func (o *tTimeoutError) Timeout() bool   { return true }
 func (o *tTimeoutError) Temporary() bool { return true }
 
+// start a stand-in provider; its first keys response gives RSA, EC & OKP keys, and each later
+// one adds an RSA key. Its /token accepts refresh token "refresh". Returns issuer, and function
+// to make tokens with default claims, which iClaims may replace or (with nil) remove.
+func _testOpenidProvider() (aIss string, aSign func(iKid string, iClaims tMsg) *tOpenidToken) {
+   fB64 := base64.RawURLEncoding.EncodeToString
+   type tTestKey struct { alg string; key interface{} }
+   var aPks []tTestKey
+   var aKeys []tMsg
+   for _, aKid := range [...]string{"kid0", "kid-es", "kid-ed", "kid1", "kid2"} {
+      switch aKid {
+      case "kid-es":
+         aPk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+         if err != nil { panic(err) }
+         aPks = append(aPks, tTestKey{"ES256", aPk})
+         aKeys = append(aKeys, tMsg{"kty":"EC", "kid":aKid, "crv":"P-256",
+                                    "x":fB64(aPk.X.Bytes()), "y":fB64(aPk.Y.Bytes())}) // no alg
+      case "kid-ed":
+         aPub, aPk, err := ed25519.GenerateKey(rand.Reader)
+         if err != nil { panic(err) }
+         aPks = append(aPks, tTestKey{"EdDSA", aPk})
+         aKeys = append(aKeys, tMsg{"kty":"OKP", "alg":"EdDSA", "kid":aKid, "crv":"Ed25519",
+                                    "x":fB64(aPub)})
+      default:
+         aPk, err := rsa.GenerateKey(rand.Reader, 1024)
+         if err != nil { panic(err) }
+         aBuf := make([]byte, 4)
+         binary.LittleEndian.PutUint32(aBuf, uint32(aPk.E))
+         if aBuf[3] == 0 { aBuf = aBuf[:3] }
+         aPks = append(aPks, tTestKey{"RS256", aPk})
+         aKeys = append(aKeys, tMsg{"kty":"RSA", "alg":"RS256", "kid":aKid,
+                                    "e":fB64(aBuf), "n":fB64(aPk.N.Bytes())})
+      }
+   }
+   aLen := 2
+   var aDoor sync.Mutex
+   aMux := http.NewServeMux()
+   aLn, err := net.Listen("tcp", "127.0.0.1:0")
+   if err != nil { panic(err) }
+   go http.Serve(aLn, aMux)
+   aIss = "http://" + aLn.Addr().String()
+   fServe := func(cResp http.ResponseWriter, cObj interface{}) {
+      cResp.Header().Set("Content-Type", "application/json")
+      err := json.NewEncoder(cResp).Encode(cObj)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "OpenID provider test: %v\n", err)
+      }
+   }
+   aMux.HandleFunc(kOpenidDiscovery, func(cResp http.ResponseWriter, cReq *http.Request) {
+      fServe(cResp, tMsg{"issuer":aIss, "jwks_uri":aIss +"/keys"})
+   })
+   aMux.HandleFunc("/keys", func(cResp http.ResponseWriter, cReq *http.Request) {
+      aDoor.Lock()
+      if aLen < len(aKeys) { aLen++ }
+      cKeys := tMsg{"keys":aKeys[:aLen]}
+      aDoor.Unlock()
+      fServe(cResp, cKeys)
+   })
+
+   aMux.HandleFunc("/token", func(cResp http.ResponseWriter, cReq *http.Request) {
+      if cReq.PostFormValue("grant_type") != "refresh_token" ||
+         cReq.PostFormValue("refresh_token") != "refresh" || cReq.PostForm["d"] == nil {
+         cResp.Header().Set("Content-Type", "application/json")
+         cResp.WriteHeader(http.StatusBadRequest)
+         fmt.Fprint(cResp, `{"error":"invalid_grant"}`)
+         return
+      }
+      cTok := aSign("kid0", tMsg{"nonce":"original", // of original authentication
+                                 "auth_time":time.Now().Add(-time.Hour).Unix()})
+      cTok.Refresh_token = "refresh2"
+      fServe(cResp, cTok)
+   })
+
+   aSign = func(cKid string, cClaims tMsg) *tOpenidToken {
+      var cKey tTestKey
+      for c := range aKeys {
+         if aKeys[c]["kid"] == cKid { cKey = aPks[c] }
+      }
+      cIdH := tMsg{"kid":cKid, "alg":cKey.alg}
+      cIdC := tMsg{"sub":"subject", "iss":aIss, "aud":"audience",
+                   "exp": time.Now().Add(time.Minute).Unix(), "iat": time.Now().Unix()}
+      for cK, cV := range cClaims {
+         if cV == nil {
+            delete(cIdC, cK)
+         } else {
+            cIdC[cK] = cV
+         }
+      }
+      cTok := &tOpenidToken{Token_type:"Bearer", Expires_in:3600, Access_token:"access"}
+
+      cBuf, err := json.Marshal(&cIdH)
+      if err != nil { panic(err) }
+      cTok.Id_token = fB64(cBuf)
+
+      cBuf, err = json.Marshal(&cIdC)
+      if err != nil { panic(err) }
+      cTok.Id_token += "." + fB64(cBuf)
+
+      cHash := sha256.Sum256([]byte(cTok.Id_token))
+      switch cPk := cKey.key.(type) {
+      case *rsa.PrivateKey:
+         cBuf, err = rsa.SignPKCS1v15(nil, cPk, crypto.SHA256, cHash[:])
+         if err != nil { panic(err) }
+      case *ecdsa.PrivateKey:
+         cR, cS, err := ecdsa.Sign(rand.Reader, cPk, cHash[:])
+         if err != nil { panic(err) }
+         cBuf = make([]byte, 64)
+         cRb, cSb := cR.Bytes(), cS.Bytes()
+         copy(cBuf[32-len(cRb):], cRb)
+         copy(cBuf[64-len(cSb):], cSb)
+      case ed25519.PrivateKey:
+         cBuf = ed25519.Sign(cPk, []byte(cTok.Id_token))
+      }
+      cTok.Id_token += "." + fB64(cBuf)
+      return cTok
+   }
+   return aIss, aSign
+}
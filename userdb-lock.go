@@ -0,0 +1,27 @@
+// Copyright 2026 Liam Breck
+// Published at https://github.com/networkimprov/mnm
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+// +build !windows
+
+package main
+
+import (
+   "os"
+   "syscall"
+)
+
+// open lock file & flock it; aBusy if another process holds it
+func openLock(iPath string) (aFd *os.File, aBusy bool, err error) {
+   aFd, err = os.OpenFile(iPath, os.O_RDWR|os.O_CREATE, 0600)
+   if err != nil { return nil, false, err }
+   err = syscall.Flock(int(aFd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+   if err != nil {
+      aFd.Close()
+      return nil, err == syscall.EWOULDBLOCK, err
+   }
+   return aFd, false, nil
+}
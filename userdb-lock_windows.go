@@ -0,0 +1,25 @@
+// Copyright 2026 Liam Breck
+// Published at https://github.com/networkimprov/mnm
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package main
+
+import (
+   "os"
+   "syscall"
+)
+
+const kErrSharingViolation syscall.Errno = 32 // not defined by package syscall
+
+// open lock file without sharing, which holds it until closed; aBusy if another process has it
+func openLock(iPath string) (aFd *os.File, aBusy bool, err error) {
+   aPath, err := syscall.UTF16PtrFromString(iPath)
+   if err != nil { return nil, false, err }
+   aH, err := syscall.CreateFile(aPath, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+                                 syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+   if err != nil { return nil, err == kErrSharingViolation, err }
+   return os.NewFile(uintptr(aH), iPath), false, nil
+}
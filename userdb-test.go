@@ -11,6 +11,7 @@ import (
    "fmt"
    "io/ioutil"
    "os"
+   "strings"
 )
 
 func TestUserDb(iPath string) bool {
@@ -29,7 +30,7 @@ func TestUserDb(iPath string) bool {
    err = ioutil.WriteFile(iPath + "/temp/group_complete%2Fg1", []byte(aJson), 0600)
    if err != nil { panic(err) }
 
-   aDb, err := NewUserDb(iPath)
+   aDb, err := NewUserDb(iPath, nil)
    if err != nil { panic(err) }
    defer os.RemoveAll(iPath) // comment out for debugging
 
@@ -42,6 +43,9 @@ func TestUserDb(iPath string) bool {
          fmt.Fprintf(os.Stderr, cMsg + "\n")
       }
    }
+   fNode := func(cUid, cNode string) tNode {
+      return aDb.user[cUid].Nodes[aDb.user[cUid].nodeKey(cNode)]
+   }
 
    // COMPLETE
    _, err = os.Lstat(iPath + "/user/complete")
@@ -77,19 +81,19 @@ func TestUserDb(iPath string) bool {
    // ADDUSER
    aUid1 = "AddUserUid1"
    aNode1 = "AddUserN1"
-   _, err = aDb.AddUser(aUid1, aNode1, nil)
-   if err != nil || aDb.user[aUid1].Nodes[aNode1].Num != 1 {
+   _, err = aDb.AddUser(aUid1, aNode1, "", nil, nil)
+   if err != nil || fNode(aUid1, aNode1).Num != 1 {
       fReport("add case failed")
    }
-   _, err = aDb.AddUser(aUid1, aNode1, nil)
-   if err != nil || aDb.user[aUid1].Nodes[aNode1].Num != 1 {
+   _, err = aDb.AddUser(aUid1, aNode1, "", nil, nil)
+   if err != nil || fNode(aUid1, aNode1).Num != 1 {
       fReport("re-add case failed")
    }
-   _, err = aDb.AddUser(aUid1, "AddUserN0", nil)
+   _, err = aDb.AddUser(aUid1, "AddUserN0", "", nil, nil)
    if err == nil || err.(*tUdbError).id != eErrMissingNode {
       fReport("add existing case succeeded: AddUser")
    }
-   _, err = aDb.AddUser("AddUserUid\x00", "AddUserN0", nil)
+   _, err = aDb.AddUser("AddUserUid\x00", "AddUserN0", "", nil, nil)
    if err == nil || err.(*tUdbError).id != eErrArgument {
       fReport("non-printable uid case succeeded: AddUser")
    }
@@ -98,27 +102,27 @@ func TestUserDb(iPath string) bool {
    // ADDNODE
    aUid1, aUid2 = "AddUserUid1", "AddNodeUid2"
    aNode1 = "AddNodeN2"
-   _, err = aDb.AddNode(aUid1, aNode1)
-   if err != nil || aDb.user[aUid1].Nodes[aNode1].Num != 2 {
+   _, err = aDb.AddNode(aUid1, aNode1, "", nil)
+   if err != nil || fNode(aUid1, aNode1).Num != 2 {
       fReport("add case failed")
    }
-   _, err = aDb.AddNode(aUid1, aNode1)
+   _, err = aDb.AddNode(aUid1, aNode1, "", nil)
    if err == nil || err.(*tUdbError).id != eErrNodeInvalid {
       fReport("re-add case failed")
    }
-   _, err = aDb.AddNode("AddNodeUid0", aNode1)
+   _, err = aDb.AddNode("AddNodeUid0", aNode1, "", nil)
    if err == nil || err.(*tUdbError).id != eErrUserInvalid {
       fReport("invalid user case succeeded: AddNode")
    }
-   aDb.AddUser(aUid2, aNode1, nil)
+   aDb.AddUser(aUid2, aNode1, "", nil, nil)
    for a := 1; a < 100; a++ {
-      _, err = aDb.AddNode(aUid2, "AddNodeN0"+fmt.Sprint(a))
+      _, err = aDb.AddNode(aUid2, "AddNodeN0"+fmt.Sprint(a), "", nil)
       if err != nil {
          fReport("add 100 case failed")
          break
       }
    }
-   _, err = aDb.AddNode(aUid2, "AddNodeN100")
+   _, err = aDb.AddNode(aUid2, "AddNodeN100", "", nil)
    if err == nil || err.(*tUdbError).id != eErrMaxNodes {
       fReport("add >100 case succeeded: AddNode")
    }
@@ -126,7 +130,7 @@ func TestUserDb(iPath string) bool {
    aFd, _ := os.OpenFile(aDb.root + "user/" + aUid2, os.O_WRONLY, 0600)
    aFd.WriteAt([]byte{'#'}, 2)
    aFd.Close()
-   _, err = aDb.AddNode(aUid2, "AddNodeN100")
+   _, err = aDb.AddNode(aUid2, "AddNodeN100", "", nil)
    if err == nil || err.(*tUdbError).id != eErrChecksum {
       fReport("checksum case succeeded")
    }
@@ -135,11 +139,11 @@ func TestUserDb(iPath string) bool {
    aUid1, aUid2 = "AddUserUid1", "DropNodeUid2"
    aNode1, aNode2 = "AddNodeN2", "DropNodeN2"
    _, err = aDb.DropNode(aUid1, aNode1)
-   if err != nil || ! aDb.user[aUid1].Nodes[aNode1].Defunct {
+   if err != nil || ! fNode(aUid1, aNode1).Defunct {
       fReport("drop case failed")
    }
    _, err = aDb.DropNode(aUid1, aNode1)
-   if err != nil || ! aDb.user[aUid1].Nodes[aNode1].Defunct {
+   if err != nil || ! fNode(aUid1, aNode1).Defunct {
       fReport("re-drop case failed")
    }
    _, err = aDb.DropNode(aUid1, "DropNodeN0")
@@ -150,12 +154,38 @@ func TestUserDb(iPath string) bool {
    if err == nil || err.(*tUdbError).id != eErrUserInvalid {
       fReport("invalid user case succeeded: DropNode")
    }
-   aDb.AddUser(aUid2, aNode2, nil)
+   aDb.AddUser(aUid2, aNode2, "", nil, nil)
    _, err = aDb.DropNode(aUid2, aNode2)
    if err == nil || err.(*tUdbError).id != eErrLastNode {
       fReport("last node case succeeded: DropNode")
    }
 
+   // DROPQID
+   aUid1 = "DropQidUid1"
+   aNode1, aNode2 = "DropQidN1", "DropQidN2"
+   aDb.AddUser(aUid1, aNode1, "", nil, nil)
+   aDb.AddNode(aUid1, aNode2, "", nil)
+   err = aDb.DropQid(aUid1, qid(aUid1, 2))
+   if err != nil || ! fNode(aUid1, aNode2).Defunct {
+      fReport("drop case failed: DropQid")
+   }
+   err = aDb.DropQid(aUid1, qid(aUid1, 2))
+   if err != nil || ! fNode(aUid1, aNode2).Defunct {
+      fReport("re-drop case failed: DropQid")
+   }
+   err = aDb.DropQid(aUid1, qid(aUid1, 3))
+   if err == nil || err.(*tUdbError).id != eErrNodeInvalid {
+      fReport("invalid qid case succeeded: DropQid")
+   }
+   err = aDb.DropQid("DropQidUid0", qid(aUid1, 1))
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("invalid user case succeeded: DropQid")
+   }
+   err = aDb.DropQid(aUid1, qid(aUid1, 1))
+   if err == nil || err.(*tUdbError).id != eErrLastNode {
+      fReport("last node case succeeded: DropQid")
+   }
+
    // ADDALIAS
    aUid1, aUid2 = "AddUserUid1", "AddAliasUid2"
    aNode1 = "AddAliasN2"
@@ -211,7 +241,7 @@ func TestUserDb(iPath string) bool {
    if err == nil || err.(*tUdbError).id != eErrUserInvalid {
       fReport("invalid user case succeeded: AddAlias")
    }
-   aDb.AddUser(aUid2, aNode1, nil)
+   aDb.AddUser(aUid2, aNode1, "", nil, nil)
    err = aDb.AddAlias(aUid2, aNat, "")
    if err == nil || err.(*tUdbError).id != eErrAliasTaken {
       fReport("already taken case succeeded: AddAlias")
@@ -261,6 +291,177 @@ func TestUserDb(iPath string) bool {
       fReport("invalid user case succeeded: Verify")
    }
 
+   // NODE HASH
+   aUid1 = "NodeHashUid1"
+   aNode1 = "NodeHashN1"
+   aDb.TempUser(aUid1, aNode1) // legacy key
+   var aQid string
+   aQid, err = aDb.Verify(aUid1, aNode1)
+   if err != nil || aQid != qid(aUid1, 1) || fNode(aUid1, aNode1).Hash == nil {
+      fReport("legacy upgrade case failed")
+   }
+   aKdf := sNodeKdf
+   err = setNodeKdf(tKdf{Alg: "argon2id", Time: 1, Memory: 64, Threads: 1})
+   if err != nil {
+      fReport("setnodekdf case failed")
+   }
+   _, err = aDb.Verify(aUid1, aNode1)
+   if err != nil || fNode(aUid1, aNode1).Hash.Kdf != sNodeKdf {
+      fReport("kdf upgrade case failed")
+   }
+   sNodeKdf = aKdf
+   delete(aDb.user, aUid1) // reload, and upgrade to prior kdf
+   _, err = aDb.Verify(aUid1, aNode1)
+   if err != nil || fNode(aUid1, aNode1).Hash.Kdf != sNodeKdf {
+      fReport("stored upgrade case failed")
+   }
+   _, err = aDb.Verify(aUid1, "MxdeHashN1") // same selector
+   if err == nil || err.(*tUdbError).id != eErrNodeInvalid {
+      fReport("invalid validator case succeeded: Verify")
+   }
+   err = setNodeKdf(tKdf{Alg: "scrypt", N: 1000, R: 8, P: 1})
+   if err == nil {
+      fReport("invalid kdf case succeeded: setNodeKdf")
+   }
+
+   // REPLACENODE & VERIFYPAKE
+   aUid1 = "ReplaceNodeUid1"
+   aNode1, aNode2 = "ReplaceNodeN1", "ReplaceNodeN2"
+   aDb.AddUser(aUid1, aNode1, "", nil, nil)
+   err = aDb.ReplaceNode(aUid1, qid(aUid1, 1), aNode2, []byte("pake"))
+   if err != nil || fNode(aUid1, aNode1).Num != 0 || fNode(aUid1, aNode2).Num != 1 {
+      fReport("replace case failed")
+   }
+   var aPake []byte
+   aQid, aPake, err = aDb.VerifyPake(aUid1, aNode2)
+   if err != nil || aQid != qid(aUid1, 1) || string(aPake) != "pake" {
+      fReport("verifypake case failed")
+   }
+   _, _, err = aDb.VerifyPake(aUid1, aNode1)
+   if err == nil || err.(*tUdbError).id != eErrNodeInvalid {
+      fReport("invalid node case succeeded: VerifyPake")
+   }
+   _, err = aDb.Verify(aUid1, aNode2)
+   if err == nil || err.(*tUdbError).id != eErrNodeInvalid {
+      fReport("pake node case succeeded: Verify")
+   }
+   err = aDb.ReplaceNode(aUid1, qid(aUid1, 1), aNode2, []byte("pake"))
+   if err == nil || err.(*tUdbError).id != eErrNodeInvalid {
+      fReport("existing node case succeeded: ReplaceNode")
+   }
+   err = aDb.ReplaceNode(aUid1, qid(aUid1, 1), aNode1, nil)
+   if err != nil || fNode(aUid1, aNode2).Num != 0 {
+      fReport("replace secret case failed")
+   }
+   aQid, err = aDb.Verify(aUid1, aNode1)
+   if err != nil || aQid != qid(aUid1, 1) {
+      fReport("replace secret case failed: Verify")
+   }
+   err = aDb.ReplaceNode(aUid1, qid(aUid1, 1), "ReplaceNodeN3", nil)
+   if err != nil {
+      fReport("rotate secret case failed")
+   }
+   _, err = aDb.Verify(aUid1, aNode1)
+   if err == nil || err.(*tUdbError).id != eErrNodeInvalid {
+      fReport("rotated secret case succeeded: Verify")
+   }
+   aQid, err = aDb.Verify(aUid1, "ReplaceNodeN3")
+   if err != nil || aQid != qid(aUid1, 1) {
+      fReport("rotate secret case failed: Verify")
+   }
+   err = aDb.ReplaceNode(aUid1, qid(aUid1, 2), "ReplaceNodeN4", nil)
+   if err == nil || err.(*tUdbError).id != eErrNodeInvalid {
+      fReport("invalid qid case succeeded: ReplaceNode")
+   }
+   err = aDb.ReplaceNode("ReplaceNodeUid0", qid(aUid1, 1), "ReplaceNodeN4", nil)
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("invalid user case succeeded: ReplaceNode")
+   }
+
+   // SETNODELOGIN & GETNODES
+   aUid1 = "GetNodesUid1"
+   aNode1, aNode2 = "GetNodesN1", "GetNodesN2"
+   aDb.AddUser(aUid1, aNode1, "first", nil, nil)
+   aDb.AddNode(aUid1, aNode2, "second", nil)
+   aDb.AddNode(aUid1, "GetNodesN3", "third", nil)
+   aDb.DropNode(aUid1, "GetNodesN3")
+   var aNew bool
+   var aPrior int64
+   aNew, aPrior, err = aDb.SetNodeLogin(aUid1, qid(aUid1, 2), "1.2.3.4")
+   if err != nil || aNew || aPrior != 0 || fNode(aUid1, aNode2).LastAddr != "1.2.3.4" || fNode(aUid1, aNode2).LastLogin == 0 {
+      fReport("setnodelogin case failed")
+   }
+   _, _, err = aDb.SetNodeLogin(aUid1, qid(aUid1, 3), "1.2.3.4")
+   if err == nil || err.(*tUdbError).id != eErrNodeInvalid {
+      fReport("defunct node case succeeded: SetNodeLogin")
+   }
+   _, _, err = aDb.SetNodeLogin("GetNodesUid0", qid(aUid1, 1), "1.2.3.4")
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("invalid user case succeeded: SetNodeLogin")
+   }
+   err = aDb.ReplaceNode(aUid1, qid(aUid1, 2), "GetNodesN4", nil)
+   if err != nil || fNode(aUid1, "GetNodesN4").Label != "second" ||
+      fNode(aUid1, "GetNodesN4").LastAddr != "1.2.3.4" {
+      fReport("replacenode keep metadata case failed")
+   }
+   var aNodeList []map[string]interface{}
+   aNodeList, err = aDb.GetNodes(aUid1)
+   if err != nil || len(aNodeList) != 2 ||
+      aNodeList[0]["Num"].(uint8) != 1 || aNodeList[0]["Label"] != "first" ||
+      aNodeList[0]["Created"].(int64) == 0 || aNodeList[0]["LastLogin"].(int64) != 0 ||
+      aNodeList[1]["Num"].(uint8) != 2 || aNodeList[1]["LastAddr"] != "1.2.3.4" {
+      fReport("getnodes case failed")
+   }
+   _, err = aDb.GetNodes("GetNodesUid0")
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("invalid user case succeeded: GetNodes")
+   }
+
+   // GETQUIET
+   var aQuiet map[string]int64
+   aQuiet, err = aDb.GetQuiet(aNodeList[1]["LastLogin"].(int64) + 1)
+   if _, ok := aQuiet[qid(aUid1, 3)]; ok || err != nil ||
+      aQuiet[qid(aUid1, 1)] != aNodeList[0]["Created"].(int64) ||
+      aQuiet[qid(aUid1, 2)] != aNodeList[1]["LastLogin"].(int64) {
+      fReport("getquiet case failed")
+   }
+   aQuiet, err = aDb.GetQuiet(aNodeList[0]["Created"].(int64))
+   if _, ok := aQuiet[qid(aUid1, 1)]; err != nil || ok {
+      fReport("not quiet case failed: GetQuiet")
+   }
+
+   // GETLOGINS
+   aNew, _, err = aDb.SetNodeLogin(aUid1, qid(aUid1, 1), "1.2.3.4")
+   if err != nil || aNew {
+      fReport("known addr case failed: SetNodeLogin")
+   }
+   aNew, aPrior, err = aDb.SetNodeLogin(aUid1, qid(aUid1, 1), "5.6.7.8")
+   if err != nil || !aNew || aPrior == 0 {
+      fReport("new addr case failed: SetNodeLogin")
+   }
+   var aLogins []map[string]interface{}
+   aLogins, err = aDb.GetLogins(aUid1)
+   if err != nil || len(aLogins) != 3 ||
+      aLogins[0]["Num"].(uint8) != 2 || aLogins[0]["Addr"] != "1.2.3.4" || aLogins[0]["Time"].(int64) == 0 ||
+      aLogins[2]["Num"].(uint8) != 1 || aLogins[2]["Addr"] != "5.6.7.8" {
+      fReport("getlogins case failed")
+   }
+   for a := 0; a < kUserLoginMax; a++ {
+      aDb.SetNodeLogin(aUid1, qid(aUid1, 1), fmt.Sprint("10.0.0.", a))
+   }
+   aLogins, err = aDb.GetLogins(aUid1)
+   if err != nil || len(aLogins) != kUserLoginMax || aLogins[0]["Addr"] != "10.0.0.0" {
+      fReport("getlogins limit case failed")
+   }
+   aNew, _, _ = aDb.SetNodeLogin(aUid1, qid(aUid1, 1), "1.2.3.4")
+   if !aNew {
+      fReport("expired addr case failed: SetNodeLogin")
+   }
+   _, err = aDb.GetLogins("GetLoginsUid0")
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("invalid user case succeeded: GetLogins")
+   }
+
    // OPEN/CLOSENODES
    aUid1 = "AddUserUid1"
    var aNodes []string
@@ -285,7 +486,7 @@ func TestUserDb(iPath string) bool {
    aGid1, aGid2 = "Ginvite/Gid1", "Ginvite/Gid2"
    aUid1, aUid2 = "AddUserUid1", "GinviteUid2"
    aAlias1, aAlias2 = "GinviteA1", "GinviteA2"
-   aDb.AddUser(aUid2, "GinviteN2", nil)
+   aDb.AddUser(aUid2, "GinviteN2", "", nil, nil)
    aDb.AddAlias(aUid2, "", aAlias2)
    aDb.AddAlias(aUid1, "", aAlias1)
    _, err = aDb.GroupInvite(aGid1, aAlias1, aAlias2, aUid2)
@@ -338,7 +539,7 @@ func TestUserDb(iPath string) bool {
    aGid1, aGid2 = "GjoinGid1", "GjoinGid2"
    aUid1, aUid2 = "AddUserUid1", "GjoinUid2"
    aAlias1, aAlias2, aAlias3 = "GjoinA1", "GjoinA2", "GjoinA3"
-   aDb.AddUser(aUid2, "GjoinN2", nil)
+   aDb.AddUser(aUid2, "GjoinN2", "", nil, nil)
    aDb.AddAlias(aUid2, "", aAlias2)
    aDb.AddAlias(aUid1, "", aAlias1)
    aDb.AddAlias(aUid1, "", aAlias3)
@@ -452,6 +653,279 @@ func TestUserDb(iPath string) bool {
       fReport("invalid group case succeeded: GroupGetUsers")
    }
 
+   // DROPUSER
+   aGid1 = "GjoinGid2"
+   aUid1 = "GjoinUid2"
+   aAlias1 = "GjoinA2"
+   var aQids []string
+   aQids, err = aDb.DropUser(aUid1)
+   if err != nil || len(aQids) != 1 || !aDb.user[aUid1].Defunct || aDb.alias[aAlias1] != kAliasDefunctUid {
+      fReport("drop case failed")
+   }
+   if _, ok := aDb.group[aGid1].Uid[aUid1]; ok {
+      fReport("drop group member case failed")
+   }
+   aQids, err = aDb.DropUser(aUid1)
+   if err != nil || len(aQids) != 1 {
+      fReport("re-drop case failed")
+   }
+   _, err = aDb.Verify(aUid1, "GjoinN2")
+   if err == nil || err.(*tUdbError).id != eErrNodeInvalid {
+      fReport("verify defunct case succeeded: DropUser")
+   }
+   _, err = aDb.AddNode(aUid1, "DropUserN2", "", nil)
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("addnode defunct case succeeded: DropUser")
+   }
+   _, err = aDb.DropUser("DropUserUid0")
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("invalid user case succeeded: DropUser")
+   }
+
+   // MSGMAX
+   aUid1 = "MsgMaxUid1"
+   aDb.AddUser(aUid1, "MsgMaxN1", "", nil, nil)
+   err = aDb.SetMsgMax(aUid1, 1000)
+   if err != nil {
+      fReport("set case failed: SetMsgMax")
+   }
+   delete(aDb.user, aUid1) // read from disk
+   var aMax int64
+   aMax, err = aDb.GetMsgMax(aUid1)
+   if err != nil || aMax != 1000 {
+      fReport("get case failed: GetMsgMax")
+   }
+   err = aDb.SetMsgMax(aUid1, 1000)
+   if err != nil {
+      fReport("re-set case failed: SetMsgMax")
+   }
+   err = aDb.SetMsgMax(aUid1, -1)
+   if err == nil || err.(*tUdbError).id != eErrArgument {
+      fReport("negative case succeeded: SetMsgMax")
+   }
+   _, err = aDb.GetMsgMax("MsgMaxUid0")
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("invalid user case succeeded: GetMsgMax")
+   }
+
+   // GETAUTH
+   aUid1 = "GetAuthUid1"
+   aDb.AddUser(aUid1, "GetAuthN1", "", nil, map[string]interface{}{"Subject":"s1", "Issuer":"i1"})
+   delete(aDb.user, aUid1) // read from disk
+   aAuth, err := aDb.GetAuth(aUid1)
+   if err != nil || aAuth["Subject"] != "s1" || aAuth["Issuer"] != "i1" {
+      fReport("get case failed: GetAuth")
+   }
+   aAuth, err = aDb.GetAuth("MsgMaxUid1")
+   if err != nil || aAuth != nil {
+      fReport("none case failed: GetAuth")
+   }
+   _, err = aDb.GetAuth("GetAuthUid0")
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("invalid user case succeeded: GetAuth")
+   }
+
+   // RECOVERY
+   aUid1 = "RecoveryUid1"
+   aDb.AddUser(aUid1, "RecoveryN1", "", nil, nil)
+   err = aDb.VerifyRecovery(aUid1, "code1")
+   if err == nil || err.(*tUdbError).id != eErrRecoveryInvalid {
+      fReport("unset case succeeded: VerifyRecovery")
+   }
+   err = aDb.SetRecovery(aUid1, "code1")
+   if err != nil {
+      fReport("set case failed: SetRecovery")
+   }
+   delete(aDb.user, aUid1) // read from disk
+   err = aDb.VerifyRecovery(aUid1, "code1")
+   if err != nil {
+      fReport("verify case failed: VerifyRecovery")
+   }
+   err = aDb.SetRecovery(aUid1, "code2")
+   if err != nil {
+      fReport("reset case failed: SetRecovery")
+   }
+   err = aDb.VerifyRecovery(aUid1, "code1")
+   if err == nil || err.(*tUdbError).id != eErrRecoveryInvalid {
+      fReport("replaced code case succeeded: VerifyRecovery")
+   }
+   err = aDb.SetRecovery(aUid1, "")
+   if err == nil || err.(*tUdbError).id != eErrArgument {
+      fReport("empty case succeeded: SetRecovery")
+   }
+   _, err = aDb.DropUser(aUid1)
+   if err != nil { panic(err) }
+   err = aDb.VerifyRecovery(aUid1, "code2")
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("defunct case succeeded: VerifyRecovery")
+   }
+   err = aDb.VerifyRecovery("RecoveryUid0", "code1")
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("invalid user case succeeded: VerifyRecovery")
+   }
+
+   // FACTOR & REAUTH
+   aUid1 = "ReauthUid1"
+   aDb.AddUser(aUid1, "ReauthN1", "", nil, nil)
+   aDb.AddNode(aUid1, "ReauthN2", "", nil)
+   var aDue, aFactor bool
+   aDue, aFactor, err = aDb.GetReauth(aUid1, qid(aUid1, 1))
+   if err != nil || aDue || aFactor {
+      fReport("unset case failed: GetReauth")
+   }
+   err = aDb.VerifyFactor(aUid1, "factor1")
+   if err == nil || err.(*tUdbError).id != eErrFactorInvalid {
+      fReport("unset case succeeded: VerifyFactor")
+   }
+   err = aDb.SetFactor(aUid1, "factor1")
+   if err != nil {
+      fReport("set case failed: SetFactor")
+   }
+   err = aDb.SetReauth(aUid1, "", true)
+   if err != nil {
+      fReport("all nodes case failed: SetReauth")
+   }
+   err = aDb.SetReauth(aUid1, qid(aUid1, 2), false)
+   if err != nil {
+      fReport("one node case failed: SetReauth")
+   }
+   delete(aDb.user, aUid1) // read from disk
+   err = aDb.VerifyFactor(aUid1, "factor1")
+   if err != nil {
+      fReport("verify case failed: VerifyFactor")
+   }
+   err = aDb.VerifyFactor(aUid1, "factor2")
+   if err == nil || err.(*tUdbError).id != eErrFactorInvalid {
+      fReport("wrong secret case succeeded: VerifyFactor")
+   }
+   aDue, aFactor, err = aDb.GetReauth(aUid1, qid(aUid1, 1))
+   if err != nil || !aDue || !aFactor {
+      fReport("set case failed: GetReauth")
+   }
+   aDue, _, err = aDb.GetReauth(aUid1, qid(aUid1, 2))
+   if err != nil || aDue {
+      fReport("cleared case failed: GetReauth")
+   }
+   err = aDb.SetFactor(aUid1, "")
+   if err == nil || err.(*tUdbError).id != eErrArgument {
+      fReport("empty case succeeded: SetFactor")
+   }
+   err = aDb.SetReauth(aUid1, qid(aUid1, 3), true)
+   if err == nil || err.(*tUdbError).id != eErrNodeInvalid {
+      fReport("invalid qid case succeeded: SetReauth")
+   }
+   _, _, err = aDb.GetReauth(aUid1, qid(aUid1, 3))
+   if err == nil || err.(*tUdbError).id != eErrNodeInvalid {
+      fReport("invalid qid case succeeded: GetReauth")
+   }
+   _, err = aDb.DropUser(aUid1)
+   if err != nil { panic(err) }
+   err = aDb.VerifyFactor(aUid1, "factor1")
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("defunct case succeeded: VerifyFactor")
+   }
+   err = aDb.SetReauth("ReauthUid0", "", true)
+   if err == nil || err.(*tUdbError).id != eErrUserInvalid {
+      fReport("invalid user case succeeded: SetReauth")
+   }
+
+   // LOOKUPAUTH
+   aUid1, aUid2 = "LookupAuthUid1", "LookupAuthUid2"
+   fAuth := func(cSub string) map[string]interface{} {
+      return map[string]interface{}{"Subject":cSub, "Issuer":"https://i1"}
+   }
+   aDb.AddUser(aUid1, "LookupAuthN1", "", nil, fAuth("s1"))
+   aDb.AddUser(aUid2, "LookupAuthN2", "", nil, fAuth("s1"))
+   aDb.AddUser("LookupAuthUid3", "LookupAuthN3", "", nil, fAuth("s2"))
+   aUids, err = aDb.LookupAuth("https://i1", "s1")
+   if err != nil || len(aUids) != 2 || aUids[0] != aUid1 || aUids[1] != aUid2 {
+      fReport("lookup case failed: LookupAuth")
+   }
+   _, err = aDb.DropUser(aUid1)
+   if err != nil { panic(err) }
+   aUids, err = aDb.LookupAuth("https://i1", "s1")
+   if err != nil || len(aUids) != 1 || aUids[0] != aUid2 {
+      fReport("dropped user case failed: LookupAuth")
+   }
+   aUids, err = aDb.LookupAuth("https://i1", "s0")
+   if err != nil || len(aUids) != 0 {
+      fReport("unknown identity case failed: LookupAuth")
+   }
+   _, err = aDb.LookupAuth("", "s1")
+   if err == nil || err.(*tUdbError).id != eErrArgument {
+      fReport("empty case succeeded: LookupAuth")
+   }
+
+   // ENCRYPT
+   aPath := iPath + "-crypt"
+   aUid1, aNode1, aAlias := "CryptUid1", "CryptN1", "crypt/alias1"
+   aDbC, err := NewUserDb(aPath, nil)
+   if err != nil { panic(err) }
+   defer os.RemoveAll(aPath)
+   aDbC.AddUser(aUid1, aNode1, "", nil, map[string]interface{}{"Subject":"s1", "Issuer":"https://i1"})
+   aDbC.AddAlias(aUid1, aAlias, "")
+   _, err = NewUserDb(aPath, nil)
+   if err == nil || err.(*tUdbError).id != eErrDbLocked {
+      fReport("locked case succeeded: NewUserDb")
+   }
+   aDbC.Close()
+   aDbC, err = NewUserDb(aPath, []byte("crypt key"))
+   if err != nil {
+      fReport("migrate case failed: NewUserDb")
+   } else {
+      var aBuf []byte
+      aBuf, err = ioutil.ReadFile(aPath + "/user/" + aUid1)
+      if err != nil || aBuf[0] != kRecordCrypt {
+         fReport("sealed record case failed")
+      }
+      _, err = os.Lstat(aDbC.fileName(eTalias, aAlias))
+      if err != nil || aDbC.fileName(eTalias, aAlias) == aPath + "/alias/crypt%2Falias1" {
+         fReport("hashed alias case failed")
+      }
+      var aUid string
+      aUid, err = aDbC.Lookup(aAlias)
+      if err != nil || aUid != aUid1 {
+         fReport("lookup case failed: encrypted")
+      }
+      _, err = aDbC.Verify(aUid1, aNode1)
+      if err != nil {
+         fReport("verify case failed: encrypted")
+      }
+      var aUids []string
+      aUids, err = aDbC.LookupAuth("https://i1", "s1")
+      if err != nil || len(aUids) != 1 || aUids[0] != aUid1 {
+         fReport("lookupauth case failed: encrypted")
+      }
+      aList, _ := readDirNames(aPath + "/auth")
+      if len(aList) != 1 || !strings.HasPrefix(aList[0], kAliasHashMark) {
+         fReport("hashed auth case failed")
+      }
+      err = aDbC.AddAlias(aUid1, "crypt/alias2", "")
+      if err != nil {
+         fReport("add alias case failed: encrypted")
+      }
+      aDbC.Close()
+   }
+   _, err = NewUserDb(aPath, []byte("wrong key"))
+   if err == nil || err.(*tUdbError).id != eErrKeyInvalid {
+      fReport("wrong key case succeeded: NewUserDb")
+   }
+   _, err = NewUserDb(aPath, nil)
+   if err == nil || err.(*tUdbError).id != eErrKeyInvalid {
+      fReport("missing key case succeeded: NewUserDb")
+   }
+   aDbC, err = NewUserDb(aPath, []byte("crypt key"))
+   if err != nil {
+      fReport("reopen case failed: NewUserDb")
+   } else {
+      var aUid string
+      aUid, err = aDbC.Lookup("crypt/alias2")
+      if err != nil || aUid != aUid1 {
+         fReport("lookup case failed: reopened")
+      }
+      aDbC.Close()
+   }
+
    if aOk {
       fmt.Println("UserDb tests passed")
    }
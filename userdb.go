@@ -8,20 +8,38 @@
 package main
 
 import (
+   "crypto/aes"
+   "crypto/cipher"
+   "crypto/hmac"
+   "crypto/rand"
+   "crypto/sha256"
+   "crypto/subtle"
    "hash/crc32"
+   "encoding/base32"
+   "encoding/hex"
    "fmt"
    "io/ioutil"
    "encoding/json"
    "os"
+   "sort"
    "strings"
    "sync"
+   "time"
    "unicode"
    "net/url"
    "unicode/utf8"
+   pArgon2 "golang.org/x/crypto/argon2"
+   pScrypt "golang.org/x/crypto/scrypt"
 )
 
 const kUserNodeMax = 100
+const kUserLoginMax = 20 // length of login history
 const kAliasDefunctUid = "*defunct"
+const kCryptFile = "crypt"
+const kLockFile = "lock" // openLock excludes other processes, e.g. mnm -reauth while server runs
+const kCryptCheck = "mnm userdb key check"
+const kRecordCrypt byte = 1 // first byte of encrypted record; plaintext records start with '{'
+const kAliasHashMark = "#" // prefix of hashed alias filenames; never yielded by url.QueryEscape
 
 var sCrc32c = crc32.MakeTable(crc32.Castagnoli)
 
@@ -39,12 +57,19 @@ func checkSum(iBuf []byte) uint32 { return crc32.Checksum(iBuf, sCrc32c) }
 //:   cache add/delete ops are done inside o.xyzDoor.Lock/Unlock()
 //:   tUser and tGroup object updates are done inside aObj.door.Lock/Unlock()
 //: records are stored as files in subdirectories of o.root: user, alias, group
-//:   user/* & group/* files are json format
-//:   alias/* files are symlinks to Uid
+//:   user/* & group/* files are json format, or sealed json if the db is encrypted
+//:   alias/* files are symlinks to Uid, named by keyed hash of alias if the db is encrypted
+//:   auth/* directories are named by hash of issuer & subject, keyed if the db is encrypted,
+//:     and hold a symlink to each Uid registered with that identity
 
 type tUserDb struct {
    root string // top-level directory
    temp string // temp subdirectory; write files here first
+   lock *os.File // holds lock until Close
+
+   crypt *tCrypt // nil if db is plaintext
+   aead cipher.AEAD // seals records
+   aliasKey []byte // keys hashes of alias filenames
 
    // cache records here
    userDoor sync.RWMutex
@@ -55,18 +80,55 @@ type tUserDb struct {
    group map[string]*tGroup
 }
 
+type tCrypt struct { // stored in root/crypt
+   Salt []byte
+   Check []byte // sealed kCryptCheck, to verify key
+   Done bool // plaintext records have been encrypted
+}
+
 type tUser struct {
    sync.RWMutex
    Nodes map[string]tNode
    NonDefunctNodesCount int
    Aliases []tAlias // public names for the user
    Authentication map[string]interface{} `json:",omitempty"`
+   AuthTouched bool `json:",omitempty"` // requires index update
+   Recovery []byte `json:",omitempty"` // SHA-256 of recovery code; a random code needs no kdf
+   Factor *tNodeHash `json:",omitempty"` // salted hash of second-factor secret, for reauthentication
+   Logins []tLogin `json:",omitempty"` // recent logins, oldest first
+   Defunct bool `json:",omitempty"` // account dropped
+   MsgMax int64 `json:",omitempty"` // overrides site message size limit if > 0
    CheckSum uint32
 }
 
 type tNode struct {
   Defunct bool
   Num uint8
+  Label string `json:",omitempty"` // from client
+  Created int64 `json:",omitempty"` // Unix time; fields omitted if empty to match legacy checksums
+  LastLogin int64 `json:",omitempty"` // Unix time
+  LastAddr string `json:",omitempty"` // IP address of last login
+  Reauth bool `json:",omitempty"` // admin requires reauthentication
+  Pake []byte `json:",omitempty"` // PAKE record; key is node ref
+  Hash *tNodeHash `json:",omitempty"` // key is selector from node secret; nil if key is legacy hash
+}
+
+type tLogin struct {
+   Num uint8 // node
+   Addr string // IP address
+   Time int64 // Unix time
+}
+
+type tNodeHash struct { // salted hash of validator from node secret
+   Kdf tKdf
+   Salt, Hash []byte
+}
+
+type tKdf struct { // parameters of node secret hash
+   Alg string // "scrypt" or "argon2id"
+   N, R, P int `json:",omitempty"` // scrypt
+   Time, Memory uint32 `json:",omitempty"` // argon2id; Memory in KiB
+   Threads uint8 `json:",omitempty"` // argon2id
 }
 
 type tAlias struct {
@@ -80,12 +142,109 @@ func (o *tUser) clearTouched() {
    for a, _ := range o.Aliases {
       o.Aliases[a].EnTouched, o.Aliases[a].NatTouched = false, false
    }
+   o.AuthTouched = false
 }
 
 func qid(iUid string, iNum uint8) string {
    return fmt.Sprintf("%s.%02x", iUid, iNum)
 }
 
+//: a node secret is split in two; the trailing half selects the node record,
+//:   and the leading half is hashed with a per-node salt, using sNodeKdf
+//: records keyed by an unsalted hash of the whole secret are upgraded by Verify
+
+const kNodeSelMark = "s" // prefix of selector keys; legacy keys are base32
+const kNodeSaltLen = 16
+const kNodeHashLen = 32
+
+var sNodeBase32 = base32.NewEncoding("%+123456789BCDFGHJKLMNPQRSTVWXYZ") // as in qlib
+
+var sNodeKdf = tKdf{Alg: "scrypt", N: 1<<15, R: 8, P: 1}
+
+func setNodeKdf(iKdf tKdf) error {
+   switch iKdf.Alg {
+   case "scrypt":
+      if iKdf.N < 2 || iKdf.N & (iKdf.N-1) != 0 || iKdf.R < 1 || iKdf.P < 1 {
+         return tError("nodekdf scrypt requires n (power of 2), r, p")
+      }
+   case "argon2id":
+      if iKdf.Time < 1 || iKdf.Threads < 1 || iKdf.Memory < 8 * uint32(iKdf.Threads) {
+         return tError("nodekdf argon2id requires time, threads, memory >= 8*threads")
+      }
+   default:
+      return tError(`nodekdf alg must be "scrypt" or "argon2id"`)
+   }
+   sNodeKdf = iKdf
+   return nil
+}
+
+func (o *tKdf) hash(iData, iSalt []byte) []byte {
+   if o.Alg == "argon2id" {
+      return pArgon2.IDKey(iData, iSalt, o.Time, o.Memory, o.Threads, kNodeHashLen)
+   }
+   aHash, err := pScrypt.Key(iData, iSalt, o.N, o.R, o.P, kNodeHashLen)
+   if err != nil { panic(err) }
+   return aHash
+}
+
+func _nodeSplit(iNode string) (aKey string, aValid []byte) {
+   aN := len(iNode) / 2
+   return kNodeSelMark + hex.EncodeToString([]byte(iNode[aN:])), []byte(iNode[:aN])
+}
+
+func makeNodeHash(iNode string) (aKey string, aHash *tNodeHash) {
+   aKey, aValid := _nodeSplit(iNode)
+   aHash = &tNodeHash{Kdf: sNodeKdf, Salt: make([]byte, kNodeSaltLen)}
+   _, err := rand.Read(aHash.Salt)
+   if err != nil { panic(err) }
+   aHash.Hash = aHash.Kdf.hash(aValid, aHash.Salt)
+   return aKey, aHash
+}
+
+func _legacyNodeHash(iNode []byte) string {
+   aData := sha256.Sum256(iNode)
+   for a:=0; a < 22388; a++ {
+      aData = sha256.Sum256(aData[:])
+   }
+   aText := sNodeBase32.EncodeToString(aData[:])
+   return aText[:len(aText)-4] // omit padding
+}
+
+// return key & record for new node; iNode is node ref if iPake != nil, else node secret
+func _newNode(iNode string, iPake []byte, iNum uint8) (string, tNode) {
+   if iPake != nil {
+      return iNode, tNode{Num: iNum, Pake: iPake}
+   }
+   aKey, aHash := makeNodeHash(iNode)
+   return aKey, tNode{Num: iNum, Hash: aHash}
+}
+
+// return key of node with ref or secret iNode, or ""
+func (o *tUser) nodeKey(iNode string) string {
+   if o.Nodes[iNode].Pake != nil {
+      return iNode
+   }
+   aKey, _ := o.findNode(iNode)
+   return aKey
+}
+
+// return key of node with secret iNode, or ""; aOld if its hash should be upgraded
+func (o *tUser) findNode(iNode string) (aKey string, aOld bool) {
+   aKey, aValid := _nodeSplit(iNode)
+   if aNode, ok := o.Nodes[aKey]; ok && aNode.Hash != nil {
+      aHash := aNode.Hash.Kdf.hash(aValid, aNode.Hash.Salt)
+      if subtle.ConstantTimeCompare(aHash, aNode.Hash.Hash) != 1 {
+         return "", false
+      }
+      return aKey, aNode.Hash.Kdf != sNodeKdf
+   }
+   aKey = _legacyNodeHash([]byte(iNode))
+   if aNode, ok := o.Nodes[aKey]; ok && aNode.Hash == nil && aNode.Pake == nil {
+      return aKey, true
+   }
+   return "", false
+}
+
 type tGroup struct {
    sync.RWMutex
    Uid map[string]tMember
@@ -112,6 +271,10 @@ const (
    eErrUserInvalid; eErrMaxNodes; eErrNodeInvalid; eErrLastNode;
    eErrUnknownAlias; eErrAliasTaken; eErrAliasInvalid;
    eErrMemberJoined; eErrGroupInvalid;
+   eErrKeyInvalid;
+   eErrRecoveryInvalid;
+   eErrFactorInvalid;
+   eErrDbLocked;
 )
 
 type tType string
@@ -119,12 +282,13 @@ const (
    eTuser  tType = "user"
    eTalias tType = "alias"
    eTgroup tType = "group"
+   eTauth  tType = "auth"
 )
 
 
-func NewUserDb(iPath string) (*tUserDb, error) {
+func NewUserDb(iPath string, iKey []byte) (*tUserDb, error) {
    var err error
-   for _, aDir := range [...]tType{ "temp", eTuser, eTalias, eTgroup } {
+   for _, aDir := range [...]tType{ "temp", eTuser, eTalias, eTgroup, eTauth } {
       err = os.MkdirAll(iPath +"/"+ string(aDir), 0700)
       if err != nil { return nil, err }
    }
@@ -132,10 +296,22 @@ func NewUserDb(iPath string) (*tUserDb, error) {
    aDb := new(tUserDb)
    aDb.root = iPath +"/"
    aDb.temp = aDb.root +"temp/"
+   var aBusy bool
+   aDb.lock, aBusy, err = openLock(aDb.root + kLockFile)
+   if aBusy {
+      return nil, &tUdbError{id: eErrDbLocked, msg: "NewUserDb: "+ iPath +" in use by another process"}
+   }
+   if err != nil { return nil, err }
+   defer func() {
+      if err != nil { aDb.lock.Close() }
+   }()
    aDb.user = make(map[string]*tUser)
    aDb.alias = make(map[string]string)
    aDb.group = make(map[string]*tGroup)
 
+   err = aDb.openCrypt(iKey)
+   if err != nil { return aDb, err }
+
    aFd, err := os.Open(aDb.temp)
    if err != nil { return aDb, err }
    aTmps, err := aFd.Readdirnames(0)
@@ -159,6 +335,10 @@ func NewUserDb(iPath string) (*tUserDb, error) {
       }
    }
 
+   if aDb.crypt != nil && !aDb.crypt.Done {
+      err = aDb.encryptAll()
+      if err != nil { return aDb, err }
+   }
    return aDb, nil
 }
 
@@ -166,7 +346,7 @@ func NewUserDb(iPath string) (*tUserDb, error) {
 //: if same parameters are retried after success, ie data already exists,
 //:   function should do nothing but return success
 
-func (o *tUserDb) AddUser(iUid, iNewNode string, iAuth map[string]interface{}) (aQid string, err error) {
+func (o *tUserDb) AddUser(iUid, iNewNode, iLabel string, iPake []byte, iAuth map[string]interface{}) (aQid string, err error) {
    //: add user
    //: iUid not in o.user, or already has iNewNode
    aUser, err := o.fetchUser(iUid, eFetchMake)
@@ -177,23 +357,26 @@ func (o *tUserDb) AddUser(iUid, iNewNode string, iAuth map[string]interface{}) (
    aQid = qid(iUid, 1)
 
    if len(aUser.Nodes) != 0 {
-      if aUser.Nodes[iNewNode].Num != 1 {
+      if aUser.Nodes[aUser.nodeKey(iNewNode)].Num != 1 {
          return "", &tUdbError{id: eErrMissingNode,
-                       msg: fmt.Sprintf("AddUser: Uid %s found, Node %s missing", iUid, iNewNode)}
+                       msg: fmt.Sprintf("AddUser: Uid %s found, Node missing", iUid)}
       }
       return aQid, nil
    }
 
-   aUser.Nodes[iNewNode] = tNode{Defunct: false, Num: 1}
+   aKey, aNode := _newNode(iNewNode, iPake, 1)
+   aNode.Label, aNode.Created = iLabel, time.Now().Unix()
+   aUser.Nodes[aKey] = aNode
    aUser.NonDefunctNodesCount++
    aUser.Authentication = iAuth
+   aUser.AuthTouched = iAuth != nil
 
    err = o.putRecord(eTuser, iUid, aUser)
    if err != nil { return "", err }
    return aQid, nil
 }
 
-func (o *tUserDb) AddNode(iUid, iNewNode string) (aQid string, err error) {
+func (o *tUserDb) AddNode(iUid, iNewNode, iLabel string, iPake []byte) (aQid string, err error) {
    //: add node
    //: iUid may already have iNewNode
    aUser, err := o.fetchUser(iUid, eFetchCheck)
@@ -205,20 +388,25 @@ func (o *tUserDb) AddNode(iUid, iNewNode string) (aQid string, err error) {
 
    aUser.Lock(); defer aUser.Unlock()
 
-   if aUser.Nodes[iNewNode].Num != 0 {
-      return "", &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("AddNode: Node %s exists", iNewNode)}
+   if aUser.Defunct {
+      return "", &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("AddNode: iUid %s defunct", iUid)}
+   }
+   aKey, aNode := _newNode(iNewNode, iPake, uint8(len(aUser.Nodes))+1)
+   if aUser.Nodes[aKey].Num != 0 {
+      return "", &tUdbError{id: eErrNodeInvalid, msg: "AddNode: Node exists"}
    }
    if aUser.NonDefunctNodesCount == kUserNodeMax {
       return "", &tUdbError{id: eErrMaxNodes, msg: fmt.Sprintf("AddNode: Exceeds %d nodes", kUserNodeMax)}
    }
 
-   aUser.Nodes[iNewNode] = tNode{Defunct: false, Num: uint8(len(aUser.Nodes))+1}
+   aNode.Label, aNode.Created = iLabel, time.Now().Unix()
+   aUser.Nodes[aKey] = aNode
    aUser.NonDefunctNodesCount++
    aUser.clearTouched()
 
    err = o.putRecord(eTuser, iUid, aUser)
    if err != nil { return "", err }
-   return qid(iUid, aUser.Nodes[iNewNode].Num), nil
+   return qid(iUid, aNode.Num), nil
 }
 
 func (o *tUserDb) DropNode(iUid, iNode string) (aQid string, err error) {
@@ -233,18 +421,21 @@ func (o *tUserDb) DropNode(iUid, iNode string) (aQid string, err error) {
 
    aUser.Lock(); defer aUser.Unlock()
 
-   if aUser.Nodes[iNode].Num == 0 {
-      return "", &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("DropNode: iNode %s invalid", iNode)}
+   aKey := aUser.nodeKey(iNode)
+   aNode := aUser.Nodes[aKey]
+   if aNode.Num == 0 {
+      return "", &tUdbError{id: eErrNodeInvalid, msg: "DropNode: iNode invalid"}
    }
-   aQid = qid(iUid, aUser.Nodes[iNode].Num)
-   if aUser.Nodes[iNode].Defunct {
+   aQid = qid(iUid, aNode.Num)
+   if aNode.Defunct {
       return aQid, nil
    }
    if aUser.NonDefunctNodesCount <= 1 {
       return "", &tUdbError{id: eErrLastNode, msg: "DropNode: cannot drop last node"}
    }
 
-   aUser.Nodes[iNode] = tNode{Defunct: true, Num: aUser.Nodes[iNode].Num}
+   aNode.Defunct = true
+   aUser.Nodes[aKey] = aNode
    aUser.NonDefunctNodesCount--
    aUser.clearTouched()
 
@@ -253,12 +444,76 @@ func (o *tUserDb) DropNode(iUid, iNode string) (aQid string, err error) {
    return aQid, nil
 }
 
+func (o *tUserDb) DropQid(iUid, iQid string) error {
+   //: mark node having queue iQid defunct
+   //: iUid has iQid
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return err }
+
+   if aUser == nil {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("DropQid: iUid %s not found", iUid)}
+   }
+
+   aUser.Lock(); defer aUser.Unlock()
+
+   for aK, aV := range aUser.Nodes {
+      if qid(iUid, aV.Num) != iQid {
+         continue
+      }
+      if aV.Defunct {
+         return nil
+      }
+      if aUser.NonDefunctNodesCount <= 1 {
+         return &tUdbError{id: eErrLastNode, msg: "DropQid: cannot drop last node"}
+      }
+      aV.Defunct = true
+      aUser.Nodes[aK] = aV
+      aUser.NonDefunctNodesCount--
+      aUser.clearTouched()
+      return o.putRecord(eTuser, iUid, aUser)
+   }
+   return &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("DropQid: iQid %s invalid", iQid)}
+}
+
+func (o *tUserDb) ReplaceNode(iUid, iQid, iNewNode string, iPake []byte) error {
+   //: rekey node having queue iQid to iNewNode, keeping its Num
+   //: iUid has iQid; iNewNode is node ref if iPake != nil, else node secret
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return err }
+
+   if aUser == nil {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("ReplaceNode: iUid %s not found", iUid)}
+   }
+
+   aNewKey, aNewNode := _newNode(iNewNode, iPake, 0) // hash outside lock
+
+   aUser.Lock(); defer aUser.Unlock()
+
+   if aUser.Nodes[aNewKey].Num != 0 {
+      return &tUdbError{id: eErrNodeInvalid, msg: "ReplaceNode: Node exists"}
+   }
+   for aK, aV := range aUser.Nodes {
+      if qid(iUid, aV.Num) != iQid {
+         continue
+      }
+      if aV.Defunct {
+         return &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("ReplaceNode: iQid %s defunct", iQid)}
+      }
+      delete(aUser.Nodes, aK)
+      aV.Pake, aV.Hash = aNewNode.Pake, aNewNode.Hash
+      aUser.Nodes[aNewKey] = aV
+      aUser.clearTouched()
+      return o.putRecord(eTuser, iUid, aUser)
+   }
+   return &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("ReplaceNode: iQid %s invalid", iQid)}
+}
+
 func (o *tUserDb) AddAlias(iUid, iNat, iEn string) error {
    //: add aliases to iUid and o.alias
    //: iNat != iEn, iNat or iEn != ""
    if iNat == iEn {
       if iNat == "" {
-         return &tUdbError{id: eErrArgument, msg: fmt.Sprintf("AddAlias: empty strings", iNat)}
+         return &tUdbError{id: eErrArgument, msg: "AddAlias: empty strings"}
       }
       iNat = ""
    }
@@ -295,6 +550,10 @@ func (o *tUserDb) AddAlias(iUid, iNat, iEn string) error {
 
    aUser.Lock(); defer aUser.Unlock()
 
+   if aUser.Defunct {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("AddAlias: iUid %s defunct", iUid)}
+   }
+
    o.algrDoor.Lock(); defer o.algrDoor.Unlock()
 
    for _, aAlias := range aAliases {
@@ -363,11 +622,283 @@ func (o *tUserDb) DropAlias(iUid, iAlias string) error {
    return nil
 }
 
-//func (o *tUserDb) DropUser(iUid string) error { return nil }
+func (o *tUserDb) DropUser(iUid string) (aQids []string, err error) {
+   //: mark user, nodes & aliases defunct, remove user from groups
+   //: return Qids of all nodes
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return nil, err }
+
+   if aUser == nil {
+      return nil, &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("DropUser: iUid %s not found", iUid)}
+   }
+
+   aUser.Lock(); defer aUser.Unlock()
+
+   for _, aNode := range aUser.Nodes {
+      aQids = append(aQids, qid(iUid, aNode.Num))
+   }
+   if aUser.Defunct {
+      return aQids, nil
+   }
+
+   // groups first, so a retry after crash finds any remaining memberships
+   aFd, err := os.Open(o.root + string(eTgroup))
+   if err != nil { return nil, err }
+   aGids, err := aFd.Readdirnames(0)
+   aFd.Close()
+   if err != nil { return nil, err }
+   for _, aGid := range aGids {
+      aGid, err = url.QueryUnescape(aGid)
+      if err != nil { return nil, err }
+      var aGroup *tGroup
+      aGroup, err = o.fetchGroup(aGid, eFetchCheck)
+      if err != nil {
+         if aErr, _ := err.(*tUdbError); aErr == nil || aErr.id != eErrChecksum { return nil, err }
+         fmt.Fprintf(os.Stderr, "DropUser: skipped %s\n", err.Error())
+         continue
+      }
+      if aGroup == nil { continue }
+      aGroup.Lock()
+      if _, ok := aGroup.Uid[iUid]; ok {
+         delete(aGroup.Uid, iUid)
+         err = o.putRecord(eTgroup, aGid, aGroup)
+      }
+      aGroup.Unlock()
+      if err != nil { return nil, err }
+   }
+
+   aUser.clearTouched()
+   o.algrDoor.Lock()
+   for a, _ := range aUser.Aliases {
+      aAl := &aUser.Aliases[a]
+      if aAl.En != "" {
+         aAl.EnDefunct, aAl.EnTouched = true, true
+         o.alias[aAl.En] = kAliasDefunctUid
+      }
+      if aAl.Nat != "" {
+         aAl.NatDefunct, aAl.NatTouched = true, true
+         o.alias[aAl.Nat] = kAliasDefunctUid
+      }
+   }
+   o.algrDoor.Unlock()
+   for aK, aV := range aUser.Nodes {
+      aV.Defunct = true
+      aUser.Nodes[aK] = aV
+   }
+   aUser.NonDefunctNodesCount = 0
+   aUser.Defunct = true
+   aUser.AuthTouched = aUser.Authentication != nil
+
+   err = o.putRecord(eTuser, iUid, aUser)
+   if err != nil { return nil, err }
+   return aQids, nil
+}
+
+func (o *tUserDb) SetMsgMax(iUid string, iMax int64) error {
+   //: set per-user message size limit; 0 reverts to site limit
+   if iMax < 0 {
+      return &tUdbError{id: eErrArgument, msg: fmt.Sprintf("SetMsgMax: iMax %d invalid", iMax)}
+   }
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return err }
+
+   if aUser == nil {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("SetMsgMax: iUid %s not found", iUid)}
+   }
+
+   aUser.Lock(); defer aUser.Unlock()
+
+   if aUser.MsgMax == iMax {
+      return nil
+   }
+   aUser.MsgMax = iMax
+   err = o.putRecord(eTuser, iUid, aUser)
+   return err
+}
+
+func (o *tUserDb) GetMsgMax(iUid string) (aMax int64, err error) {
+   //: return per-user message size limit, or 0
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return 0, err }
+
+   if aUser == nil {
+      return 0, &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("GetMsgMax: iUid %s not found", iUid)}
+   }
+
+   aUser.RLock(); defer aUser.RUnlock()
+   return aUser.MsgMax, nil
+}
+
+func (o *tUserDb) GetAuth(iUid string) (aAuth map[string]interface{}, err error) {
+   //: return third party authentication stored by AddUser, or nil
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return nil, err }
+
+   if aUser == nil {
+      return nil, &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("GetAuth: iUid %s not found", iUid)}
+   }
+
+   aUser.RLock(); defer aUser.RUnlock()
+   if aUser.Authentication == nil {
+      return nil, nil
+   }
+   aAuth = make(map[string]interface{}, len(aUser.Authentication))
+   for aK, aV := range aUser.Authentication {
+      aAuth[aK] = aV
+   }
+   return aAuth, nil
+}
+
+func (o *tUserDb) SetRecovery(iUid, iCode string) error {
+   //: store hash of recovery code, replacing any prior one
+   if iCode == "" {
+      return &tUdbError{id: eErrArgument, msg: "SetRecovery: iCode is empty"}
+   }
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return err }
+
+   if aUser == nil {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("SetRecovery: iUid %s not found", iUid)}
+   }
+
+   aUser.Lock(); defer aUser.Unlock()
+
+   if aUser.Defunct {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("SetRecovery: iUid %s defunct", iUid)}
+   }
+   aHash := sha256.Sum256([]byte(iCode))
+   aUser.Recovery = aHash[:]
+   aUser.clearTouched()
+   return o.putRecord(eTuser, iUid, aUser)
+}
+
+func (o *tUserDb) VerifyRecovery(iUid, iCode string) error {
+   //: check recovery code
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return err }
+
+   if aUser == nil {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("VerifyRecovery: iUid %s not found", iUid)}
+   }
+
+   aUser.RLock(); defer aUser.RUnlock()
+
+   if aUser.Defunct {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("VerifyRecovery: iUid %s defunct", iUid)}
+   }
+   aHash := sha256.Sum256([]byte(iCode))
+   if aUser.Recovery == nil || subtle.ConstantTimeCompare(aHash[:], aUser.Recovery) != 1 {
+      return &tUdbError{id: eErrRecoveryInvalid, msg: "VerifyRecovery: iCode invalid"}
+   }
+   return nil
+}
+
+func (o *tUserDb) SetFactor(iUid, iSecret string) error {
+   //: store salted hash of second-factor secret, replacing any prior one
+   if iSecret == "" {
+      return &tUdbError{id: eErrArgument, msg: "SetFactor: iSecret is empty"}
+   }
+   aHash := &tNodeHash{Kdf: sNodeKdf, Salt: make([]byte, kNodeSaltLen)}
+   _, err := rand.Read(aHash.Salt)
+   if err != nil { panic(err) }
+   aHash.Hash = aHash.Kdf.hash([]byte(iSecret), aHash.Salt) // outside lock; kdf is slow
+
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return err }
+
+   if aUser == nil {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("SetFactor: iUid %s not found", iUid)}
+   }
+
+   aUser.Lock(); defer aUser.Unlock()
+
+   if aUser.Defunct {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("SetFactor: iUid %s defunct", iUid)}
+   }
+   aUser.Factor = aHash
+   aUser.clearTouched()
+   return o.putRecord(eTuser, iUid, aUser)
+}
+
+func (o *tUserDb) VerifyFactor(iUid, iSecret string) error {
+   //: check second-factor secret
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return err }
+
+   if aUser == nil {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("VerifyFactor: iUid %s not found", iUid)}
+   }
+
+   aUser.RLock()
+   aFactor, aDefunct := aUser.Factor, aUser.Defunct
+   aUser.RUnlock()
+
+   if aDefunct {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("VerifyFactor: iUid %s defunct", iUid)}
+   }
+   if aFactor == nil ||
+      subtle.ConstantTimeCompare(aFactor.Kdf.hash([]byte(iSecret), aFactor.Salt), aFactor.Hash) != 1 {
+      return &tUdbError{id: eErrFactorInvalid, msg: "VerifyFactor: iSecret invalid"}
+   }
+   return nil
+}
+
+func (o *tUserDb) SetReauth(iUid, iQid string, iDue bool) error {
+   //: set or clear reauthentication requirement of node having queue iQid
+   //: iQid "" sets it for all non-defunct nodes
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return err }
+
+   if aUser == nil {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("SetReauth: iUid %s not found", iUid)}
+   }
+
+   aUser.Lock(); defer aUser.Unlock()
+
+   if aUser.Defunct {
+      return &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("SetReauth: iUid %s defunct", iUid)}
+   }
+   aFound := false
+   for aK, aV := range aUser.Nodes {
+      if aV.Defunct || iQid != "" && qid(iUid, aV.Num) != iQid {
+         continue
+      }
+      aFound = true
+      aV.Reauth = iDue
+      aUser.Nodes[aK] = aV
+   }
+   if !aFound {
+      return &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("SetReauth: iQid %s invalid", iQid)}
+   }
+   aUser.clearTouched()
+   return o.putRecord(eTuser, iUid, aUser)
+}
+
+func (o *tUserDb) GetReauth(iUid, iQid string) (aDue, aFactor bool, err error) {
+   //: return whether node having queue iQid requires reauthentication, and user has a second factor
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return false, false, err }
+
+   if aUser == nil {
+      return false, false, &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("GetReauth: iUid %s not found", iUid)}
+   }
+
+   aUser.RLock(); defer aUser.RUnlock()
+
+   if aUser.Defunct {
+      return false, false, &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("GetReauth: iUid %s defunct", iUid)}
+   }
+   for _, aV := range aUser.Nodes {
+      if !aV.Defunct && qid(iUid, aV.Num) == iQid {
+         return aV.Reauth, aUser.Factor != nil, nil
+      }
+   }
+   return false, false, &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("GetReauth: iQid %s invalid", iQid)}
+}
 
 func (o *tUserDb) Verify(iUid, iNode string) (aQid string, err error) {
-   //: return Qid of node
-   //: iUid has iNode
+   //: return Qid of node, upgrading its hash if needed
+   //: iUid has node secret iNode
    aUser, err := o.fetchUser(iUid, eFetchCheck)
    if err != nil { return "", err }
 
@@ -375,15 +906,171 @@ func (o *tUserDb) Verify(iUid, iNode string) (aQid string, err error) {
       return "", &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("Verify: iUid %s not found", iUid)}
    }
 
+   aUser.RLock()
+   aKey, aOld := aUser.findNode(iNode)
+   aNode := aUser.Nodes[aKey]
+   aUser.RUnlock()
+
+   if aNode.Defunct {
+      return "", &tUdbError{id: eErrNodeInvalid, msg: "Verify: iNode defunct"}
+   }
+   if aNode.Num == 0 {
+      return "", &tUdbError{id: eErrNodeInvalid, msg: "Verify: iNode invalid"}
+   }
+   if aOld {
+      err = o.upgradeNode(iUid, aUser, aKey, iNode)
+      if err != nil { return "", err }
+   }
+   return qid(iUid, aNode.Num), nil
+}
+
+func (o *tUserDb) upgradeNode(iUid string, iUser *tUser, iKey, iNode string) error {
+   aNewKey, aHash := makeNodeHash(iNode)
+
+   iUser.Lock(); defer iUser.Unlock()
+
+   aNode, ok := iUser.Nodes[iKey]
+   if !ok || aNode.Defunct {
+      return nil // changed since Verify
+   }
+   delete(iUser.Nodes, iKey)
+   aNode.Hash = aHash
+   iUser.Nodes[aNewKey] = aNode
+   iUser.clearTouched()
+   return o.putRecord(eTuser, iUid, iUser)
+}
+
+func (o *tUserDb) VerifyPake(iUid, iRef string) (aQid string, aPake []byte, err error) {
+   //: return Qid & PAKE record of node
+   //: iUid has node ref iRef
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return "", nil, err }
+
+   if aUser == nil {
+      return "", nil, &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("VerifyPake: iUid %s not found", iUid)}
+   }
+
+   aUser.RLock(); defer aUser.RUnlock()
+
+   aNode := aUser.Nodes[iRef]
+   if aNode.Defunct {
+      return "", nil, &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("VerifyPake: iRef %s defunct", iRef)}
+   }
+   if aNode.Pake == nil {
+      return "", nil, &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("VerifyPake: iRef %s invalid", iRef)}
+   }
+   return qid(iUid, aNode.Num), aNode.Pake, nil
+}
+
+func (o *tUserDb) SetNodeLogin(iUid, iQid, iAddr string) (aNew bool, aPrior int64, err error) {
+   //: record login time & address of node having queue iQid, and add to login history
+   //: aNew if history is not empty and lacks iAddr; aPrior is node's previous login time, or 0
+   //: iUid has iQid
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return false, 0, err }
+
+   if aUser == nil {
+      return false, 0, &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("SetNodeLogin: iUid %s not found", iUid)}
+   }
+
+   aUser.Lock(); defer aUser.Unlock()
+
+   for aK, aV := range aUser.Nodes {
+      if qid(iUid, aV.Num) != iQid {
+         continue
+      }
+      if aV.Defunct {
+         return false, 0, &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("SetNodeLogin: iQid %s defunct", iQid)}
+      }
+      aNew = len(aUser.Logins) > 0
+      for _, aL := range aUser.Logins {
+         if aL.Addr == iAddr { aNew = false; break }
+      }
+      aPrior = aV.LastLogin
+      aV.LastLogin, aV.LastAddr = time.Now().Unix(), iAddr
+      aUser.Nodes[aK] = aV
+      aUser.Logins = append(aUser.Logins, tLogin{Num: aV.Num, Addr: iAddr, Time: aV.LastLogin})
+      if len(aUser.Logins) > kUserLoginMax {
+         aUser.Logins = append([]tLogin{}, aUser.Logins[len(aUser.Logins)-kUserLoginMax:]...)
+      }
+      aUser.clearTouched()
+      return aNew, aPrior, o.putRecord(eTuser, iUid, aUser)
+   }
+   return false, 0, &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("SetNodeLogin: iQid %s invalid", iQid)}
+}
+
+func (o *tUserDb) GetLogins(iUid string) (aLogins []map[string]interface{}, err error) {
+   //: return Num, Addr, Time of recent logins, oldest first
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return nil, err }
+
+   if aUser == nil {
+      return nil, &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("GetLogins: iUid %s not found", iUid)}
+   }
+
+   aUser.RLock(); defer aUser.RUnlock()
+
+   if aUser.Defunct {
+      return nil, &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("GetLogins: iUid %s defunct", iUid)}
+   }
+   aLogins = make([]map[string]interface{}, len(aUser.Logins))
+   for a, aL := range aUser.Logins {
+      aLogins[a] = map[string]interface{}{"Num":aL.Num, "Addr":aL.Addr, "Time":aL.Time}
+   }
+   return aLogins, nil
+}
+
+func (o *tUserDb) GetQuiet(iBefore int64) (aQids map[string]int64, err error) {
+   //: return nodes of all users whose last login, or creation if none, precedes iBefore, with that time
+   //: time is 0 for nodes made before it was recorded; omits defunct nodes & users
+   aList, err := readDirNames(o.root + string(eTuser))
+   if err != nil { return nil, err }
+   aQids = make(map[string]int64)
+   for _, aUid := range aList {
+      aUser, err := o.fetchUser(aUid, eFetchCheck)
+      if err != nil {
+         if aErr, _ := err.(*tUdbError); aErr == nil || aErr.id != eErrChecksum { return nil, err }
+         fmt.Fprintf(os.Stderr, "GetQuiet: skipped %s\n", err.Error())
+         continue
+      }
+      if aUser == nil {
+         continue
+      }
+      aUser.RLock()
+      for _, aNode := range aUser.Nodes {
+         aTime := aNode.LastLogin; if aTime == 0 { aTime = aNode.Created }
+         if !aUser.Defunct && !aNode.Defunct && aTime < iBefore {
+            aQids[qid(aUid, aNode.Num)] = aTime
+         }
+      }
+      aUser.RUnlock()
+   }
+   return aQids, nil
+}
+
+func (o *tUserDb) GetNodes(iUid string) (aNodes []map[string]interface{}, err error) {
+   //: return Num, Label, Created, LastLogin, LastAddr of non-defunct nodes, ordered by Num
+   aUser, err := o.fetchUser(iUid, eFetchCheck)
+   if err != nil { return nil, err }
+
+   if aUser == nil {
+      return nil, &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("GetNodes: iUid %s not found", iUid)}
+   }
+
    aUser.RLock(); defer aUser.RUnlock()
 
-   if aUser.Nodes[iNode].Defunct {
-      return "", &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("Verify: iNode %s defunct", iNode)}
+   if aUser.Defunct {
+      return nil, &tUdbError{id: eErrUserInvalid, msg: fmt.Sprintf("GetNodes: iUid %s defunct", iUid)}
    }
-   if aUser.Nodes[iNode].Num == 0 {
-      return "", &tUdbError{id: eErrNodeInvalid, msg: fmt.Sprintf("Verify: iNode %s invalid", iNode)}
+   for _, aV := range aUser.Nodes {
+      if aV.Defunct {
+         continue
+      }
+      aNodes = append(aNodes, map[string]interface{}{"Num":aV.Num, "Label":aV.Label, "Created":aV.Created,
+                                                     "LastLogin":aV.LastLogin, "LastAddr":aV.LastAddr})
    }
-   return qid(iUid, aUser.Nodes[iNode].Num), nil
+   sort.Slice(aNodes, func(cA, cB int) bool { return aNodes[cA]["Num"].(uint8) < aNodes[cB]["Num"].(uint8) })
+   return aNodes, nil
 }
 
 func (o *tUserDb) OpenNodes(iUid string) (aQids []string, err error) {
@@ -448,6 +1135,20 @@ func (o *tUserDb) Lookup(iAlias string) (aUid string, err error) {
    return aUid, nil
 }
 
+func (o *tUserDb) LookupAuth(iIss, iSub string) (aUids []string, err error) {
+   //: return uids registered with third party identity, excluding dropped users
+   if iIss == "" || iSub == "" {
+      return nil, &tUdbError{id: eErrArgument, msg: "LookupAuth: iIss or iSub is empty"}
+   }
+   aUids, err = readDirNames(o.root + string(eTauth) +"/"+ o.authKey(iIss, iSub))
+   if err != nil {
+      if !os.IsNotExist(err) { return nil, err }
+      return nil, nil
+   }
+   sort.Strings(aUids)
+   return aUids, nil
+}
+
 func (o *tUserDb) GroupInvite(iGid, iAlias, iByAlias, iByUid string) (aUid string, err error) {
    //: add member to group, possibly create group
    //: iAlias exists
@@ -635,13 +1336,16 @@ func (o *tUserDb) GroupGetUsers(iGid, iByUid string) (aUids []string, err error)
 
 // TempXyz methods for testing use only
 
+// TempUser & TempNode give legacy keys to nodes, so Verify upgrades them
+
 func (o *tUserDb) TempUser(iUid, iNewNode string) {
-   o.user[iUid] = &tUser{Nodes: map[string]tNode{iNewNode: {Num:1}}, NonDefunctNodesCount:1}
+   aKey := _legacyNodeHash([]byte(iNewNode))
+   o.user[iUid] = &tUser{Nodes: map[string]tNode{aKey: {Num:1}}, NonDefunctNodesCount:1}
 }
 
 func (o *tUserDb) TempNode(iUid, iNewNode string) {
    aUser := o.user[iUid]
-   aUser.Nodes[iNewNode] = tNode{Num:2}
+   aUser.Nodes[_legacyNodeHash([]byte(iNewNode))] = tNode{Num:2}
    aUser.NonDefunctNodesCount = 2
 }
 
@@ -657,6 +1361,11 @@ func (o *tUserDb) TempGroup(iGid, iUid, iAlias string) {
    o.group[iGid].Uid[iUid] = tMember{Alias: iAlias, Status: aS}
 }
 
+func (o *tUserDb) Close() error {
+   //: release lock, so another process may open the db
+   return o.lock.Close()
+}
+
 func (o *tUserDb) Erase() {
    err := os.RemoveAll(o.root)
    if err != nil { panic(err) }
@@ -686,7 +1395,11 @@ func invalidAscii(i string) bool {
 }
 
 func (o *tUserDb) fileName(iT tType, iN string) string {
-   if iT != eTuser {
+   if iT == eTalias && o.aliasKey != nil {
+      aMac := hmac.New(sha256.New, o.aliasKey)
+      aMac.Write([]byte(iN))
+      iN = kAliasHashMark + hex.EncodeToString(aMac.Sum(nil))
+   } else if iT != eTuser {
       iN = url.QueryEscape(iN)
    }
    return o.root + string(iT) +"/"+ iN
@@ -699,6 +1412,43 @@ func (o *tUserDb) fileTemp(iT tType, iN string) string {
    return o.temp + string(iT) +"_"+ iN
 }
 
+// name of auth directory for identity
+func (o *tUserDb) authKey(iIss, iSub string) string {
+   aId := []byte(iIss +"\n"+ iSub) // issuer is a URL, so has no newline
+   if o.aliasKey != nil {
+      aMac := hmac.New(sha256.New, o.aliasKey)
+      aMac.Write(aId)
+      return kAliasHashMark + hex.EncodeToString(aMac.Sum(nil))
+   }
+   aSum := sha256.Sum256(aId)
+   return hex.EncodeToString(aSum[:])
+}
+
+// add or remove symlink to iUid in its auth directory
+func (o *tUserDb) putAuthLink(iUid string, iUser *tUser) {
+   aIss, _ := iUser.Authentication["Issuer"].(string)
+   aSub, _ := iUser.Authentication["Subject"].(string)
+   if aIss == "" || aSub == "" {
+      return
+   }
+   aDir := o.root + string(eTauth) +"/"+ o.authKey(aIss, aSub)
+   err := os.Mkdir(aDir, 0700)
+   if err == nil {
+      err = syncDir(o.root + string(eTauth))
+      if err != nil { panic(err) }
+   } else if !os.IsExist(err) {
+      panic(err)
+   }
+   err = os.Remove(aDir +"/"+ iUid)
+   if err != nil && !os.IsNotExist(err) { panic(err) }
+   if !iUser.Defunct {
+      err = os.Symlink(iUid, aDir +"/"+ iUid)
+      if err != nil { panic(err) }
+   }
+   err = syncDir(aDir)
+   if err != nil { panic(err) }
+}
+
 type tFetch bool
 const eFetchCheck, eFetchMake tFetch = false, true
 
@@ -789,6 +1539,10 @@ func (o *tUserDb) getRecord(iType tType, iId string) (interface{}, error) {
       if !os.IsNotExist(err) { panic(err) }
       return aObj, nil
    }
+   aBuf, err = o.decode(iType, iId, aBuf)
+   if err != nil {
+      return nil, &tUdbError{id: eErrChecksum, msg: fmt.Sprintf("decode failed for %s/%s: %s", string(iType), iId, err.Error())}
+   }
    err = json.Unmarshal(aBuf, aObj)
    if err != nil {
       return nil, &tUdbError{id: eErrChecksum, msg: fmt.Sprintf("unmarshal failed for %s/%s: %s", string(iType), iId, err.Error())}
@@ -820,13 +1574,14 @@ func (o *tUserDb) putRecord(iType tType, iId string, iObj interface{}) error {
 
    aTemp := o.fileTemp(iType, iId)
 
-   aFd, err := os.OpenFile(aTemp +".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-   if err != nil { panic(err) }
-   err = json.NewEncoder(aFd).Encode(iObj)
+   aBuf, err = json.Marshal(iObj)
    if err != nil { panic(err) }
-   err = aFd.Sync()
+   aBuf = append(aBuf, '\n')
+   if o.aead != nil {
+      aBuf = o.seal(string(iType) +"/"+ iId, aBuf)
+   }
+   err = writeSync(aTemp +".tmp", aBuf, os.O_EXCL)
    if err != nil { panic(err) }
-   aFd.Close()
 
    err = os.Link(aTemp +".tmp", aTemp)
    if err != nil { panic(err) }
@@ -836,6 +1591,15 @@ func (o *tUserDb) putRecord(iType tType, iId string, iObj interface{}) error {
    return err
 }
 
+func writeSync(iPath string, iBuf []byte, iFlag int) error {
+   aFd, err := os.OpenFile(iPath, os.O_WRONLY|os.O_CREATE|iFlag, 0600)
+   if err != nil { return err }
+   defer aFd.Close()
+   _, err = aFd.Write(iBuf)
+   if err != nil { return err }
+   return aFd.Sync()
+}
+
 func syncDir(iPath string) error {
    aFd, err := os.Open(iPath)
    if err != nil { return err }
@@ -862,6 +1626,8 @@ func (o *tUserDb) complete(iType tType, iId string, iObj interface{}) error {
          var aBuf []byte
          aBuf, err = ioutil.ReadFile(aPath)
          if err != nil { panic(err) }
+         aBuf, err = o.decode(iType, iId, aBuf)
+         if err != nil { panic(err) }
          err = json.Unmarshal(aBuf, iObj)
          if err != nil { panic(err) }
       }
@@ -883,6 +1649,9 @@ func (o *tUserDb) complete(iType tType, iId string, iObj interface{}) error {
          err = syncDir(o.root + string(eTalias))
          if err != nil { panic(err) }
       }
+      if iObj.(*tUser).AuthTouched {
+         o.putAuthLink(iId, iObj.(*tUser))
+      }
    }
 
    err = os.Remove(aTemp)
@@ -891,3 +1660,168 @@ func (o *tUserDb) complete(iType tType, iId string, iObj interface{}) error {
    if err != nil && !os.IsNotExist(err) { panic(err) }
    return nil
 }
+
+// load or create root/crypt and derive keys; with neither crypt file nor key, db is plaintext
+func (o *tUserDb) openCrypt(iKey []byte) error {
+   aCrypt := &tCrypt{}
+   aBuf, err := ioutil.ReadFile(o.root + kCryptFile)
+   if err == nil {
+      err = json.Unmarshal(aBuf, aCrypt)
+      if err != nil { return err }
+      if iKey == nil {
+         return &tUdbError{id: eErrKeyInvalid, msg: "NewUserDb: database is encrypted; key required"}
+      }
+   } else if !os.IsNotExist(err) {
+      return err
+   } else if iKey == nil {
+      return nil
+   } else {
+      aCrypt.Salt = make([]byte, 16)
+      _, err = rand.Read(aCrypt.Salt)
+      if err != nil { panic(err) }
+   }
+   if len(iKey) == 0 {
+      return &tUdbError{id: eErrKeyInvalid, msg: "NewUserDb: key is empty"}
+   }
+   aDk, err := pScrypt.Key(iKey, aCrypt.Salt, 1<<15, 8, 1, 64)
+   if err != nil { return err }
+   aBlock, err := aes.NewCipher(aDk[:32])
+   if err != nil { return err }
+   o.aead, err = cipher.NewGCM(aBlock)
+   if err != nil { return err }
+   o.aliasKey = aDk[32:]
+   o.crypt = aCrypt
+
+   if aCrypt.Check == nil {
+      aCrypt.Check = o.seal(kCryptFile, []byte(kCryptCheck))
+      return o.putCrypt()
+   }
+   aBuf, err = o.open(kCryptFile, aCrypt.Check)
+   if err != nil || string(aBuf) != kCryptCheck {
+      return &tUdbError{id: eErrKeyInvalid, msg: "NewUserDb: key incorrect"}
+   }
+   return nil
+}
+
+func (o *tUserDb) putCrypt() error {
+   aBuf, err := json.Marshal(o.crypt)
+   if err != nil { panic(err) }
+   err = writeSync(o.temp + kCryptFile +".tmp", aBuf, os.O_TRUNC)
+   if err != nil { return err }
+   err = os.Rename(o.temp + kCryptFile +".tmp", o.root + kCryptFile)
+   if err != nil { return err }
+   return syncDir(o.root)
+}
+
+// migrate plaintext records & alias filenames; may be re-run after crash
+func (o *tUserDb) encryptAll() error {
+   aTemp := o.temp + kCryptFile +"_record.tmp"
+   for _, aType := range [...]tType{eTuser, eTgroup} {
+      aDir := o.root + string(aType) +"/"
+      aList, err := readDirNames(aDir)
+      if err != nil { return err }
+      for _, aName := range aList {
+         aBuf, err := ioutil.ReadFile(aDir + aName)
+         if err != nil { return err }
+         if len(aBuf) > 0 && aBuf[0] == kRecordCrypt {
+            continue
+         }
+         aId := aName
+         if aType != eTuser {
+            aId, err = url.QueryUnescape(aName)
+            if err != nil { return err }
+         }
+         err = writeSync(aTemp, o.seal(string(aType) +"/"+ aId, aBuf), os.O_TRUNC)
+         if err != nil { return err }
+         err = os.Rename(aTemp, aDir + aName)
+         if err != nil { return err }
+      }
+      err = syncDir(aDir)
+      if err != nil { return err }
+   }
+   aDir := o.root + string(eTalias) +"/"
+   aList, err := readDirNames(aDir)
+   if err != nil { return err }
+   for _, aName := range aList {
+      if strings.HasPrefix(aName, kAliasHashMark) {
+         continue
+      }
+      aUid, err := os.Readlink(aDir + aName)
+      if err != nil { return err }
+      aAlias, err := url.QueryUnescape(aName)
+      if err != nil { return err }
+      aPath := o.fileName(eTalias, aAlias)
+      err = os.Remove(aPath)
+      if err != nil && !os.IsNotExist(err) { return err }
+      err = os.Symlink(aUid, aPath)
+      if err != nil { return err }
+      err = os.Remove(aDir + aName)
+      if err != nil { return err }
+   }
+   err = syncDir(aDir)
+   if err != nil { return err }
+
+   // auth index is rebuilt with keyed names, then plaintext names are removed
+   aList, err = readDirNames(o.root + string(eTuser))
+   if err != nil { return err }
+   for _, aUid := range aList {
+      aObj, err := o.getRecord(eTuser, aUid)
+      if err != nil { return err }
+      if aObj.(*tUser).Authentication != nil {
+         o.putAuthLink(aUid, aObj.(*tUser))
+      }
+   }
+   aDir = o.root + string(eTauth) +"/"
+   aList, err = readDirNames(aDir)
+   if err != nil { return err }
+   for _, aName := range aList {
+      if strings.HasPrefix(aName, kAliasHashMark) {
+         continue
+      }
+      err = os.RemoveAll(aDir + aName)
+      if err != nil { return err }
+   }
+   err = syncDir(aDir)
+   if err != nil { return err }
+
+   o.crypt.Done = true
+   return o.putCrypt()
+}
+
+func readDirNames(iPath string) ([]string, error) {
+   aFd, err := os.Open(iPath)
+   if err != nil { return nil, err }
+   defer aFd.Close()
+   return aFd.Readdirnames(0)
+}
+
+// decrypt record if sealed; plaintext is allowed until encryptAll completes
+func (o *tUserDb) decode(iType tType, iId string, iBuf []byte) ([]byte, error) {
+   if len(iBuf) > 0 && iBuf[0] == kRecordCrypt {
+      if o.aead == nil {
+         return nil, &tUdbError{id: eErrKeyInvalid, msg: "sealed record in plaintext database"}
+      }
+      return o.open(string(iType) +"/"+ iId, iBuf)
+   }
+   if o.crypt != nil && o.crypt.Done {
+      return nil, &tUdbError{id: eErrKeyInvalid, msg: "plaintext record in encrypted database"}
+   }
+   return iBuf, nil
+}
+
+// iAad binds the sealed data to its record name
+func (o *tUserDb) seal(iAad string, iBuf []byte) []byte {
+   aOut := make([]byte, 1 + o.aead.NonceSize(), 1 + o.aead.NonceSize() + len(iBuf) + o.aead.Overhead())
+   aOut[0] = kRecordCrypt
+   _, err := rand.Read(aOut[1:])
+   if err != nil { panic(err) }
+   return o.aead.Seal(aOut, aOut[1:], iBuf, []byte(iAad))
+}
+
+func (o *tUserDb) open(iAad string, iBuf []byte) ([]byte, error) {
+   aLen := 1 + o.aead.NonceSize()
+   if len(iBuf) < aLen || iBuf[0] != kRecordCrypt {
+      return nil, &tUdbError{id: eErrKeyInvalid, msg: "sealed record too short"}
+   }
+   return o.aead.Open(nil, iBuf[1:aLen], iBuf[aLen:], []byte(iAad))
+}
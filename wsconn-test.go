@@ -0,0 +1,69 @@
+// Copyright 2017, 2018 Liam Breck
+// Published at https://github.com/networkimprov/mnm
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package main
+
+import (
+   "fmt"
+   "net"
+   "net/http"
+   "os"
+   "strings"
+   "time"
+   pWs "golang.org/x/net/websocket"
+)
+
+func TestWsConn() bool {
+   //: exercise the WebSocket listener, print diagnostics
+   //: invoke from main() before tTestClient loop; stop program if tests fail
+   aListener, err := net.Listen("tcp", "127.0.0.1:0")
+   if err != nil { panic(err) }
+   aServer := &http.Server{Handler: newWsServer([]string{"https://app.example"})}
+   go aServer.Serve(aListener)
+   defer aServer.Close()
+   aUrl := "ws://" + aListener.Addr().String() + "/"
+
+   aOk := true
+   fReport := func(cMsg string) {
+      aOk = false
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "%s: %s\n", cMsg, err.Error())
+      } else {
+         fmt.Fprintf(os.Stderr, cMsg + "\n")
+      }
+   }
+
+   _, err = pWs.Dial(aUrl, "", "https://other.example")
+   if err == nil {
+      fReport("disallowed origin case succeeded: Dial")
+   }
+
+   aWs, err := pWs.Dial(aUrl, "", "https://App.example")
+   if err != nil {
+      fReport("allowed origin case failed: Dial")
+   } else {
+      aWs.SetDeadline(time.Now().Add(5 * time.Second))
+      aHead := `{"Op":0,"Id":"1"}` // eOpTmtpRev
+      _, err = aWs.Write([]byte(fmt.Sprintf("%04x%s", len(aHead), aHead)))
+      if err != nil {
+         fReport("tmtprev case failed: Write")
+      } else {
+         aBuf := make([]byte, 1024)
+         var aLen int
+         aLen, err = aWs.Read(aBuf)
+         if err != nil || !strings.Contains(string(aBuf[:aLen]), `"op":"tmtprev"`) {
+            fReport("tmtprev case failed: Read " + string(aBuf[:aLen]))
+         }
+      }
+      aWs.Close()
+   }
+
+   if aOk {
+      fmt.Println("WebSocket tests passed")
+   }
+   return aOk
+}